@@ -0,0 +1,584 @@
+package gokvlite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//Writes a copy of the database to w while kh stays open. Writes to kh
+//go on while it's copied, with the blocks they free held like for a
+//Snapshot, so Rekey returns ErrSnapshotOpen until it's done. The copy
+//is of the database as it was when Backup was called, and is opened
+//like any other database, with the same encryption key if there is one.
+//Returns the Seq of the copy, which incremental backups can be taken
+//since
+func (kh *KeyHandler) Backup(w io.Writer) (int64, error) {
+	kh.lock.Lock()
+	if kh.closed {
+		kh.lock.Unlock()
+		return 0, ErrClosed
+	}
+	size, regions, err := kh.backupRegions()
+	if err != nil {
+		kh.lock.Unlock()
+		return 0, err
+	}
+	seq := kh.seq
+	kh.bli.snapshots++
+	kh.lock.Unlock()
+
+	return seq, kh.endPin(kh.copyBackup(w, size, regions))
+}
+
+func (kh *KeyHandler) endPin(err error) error {
+	//Unpins the file after a backup or dump that was written without
+	//the lock, returning err or else the error unpinning
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if unpinErr := kh.unpin(); err == nil {
+		err = unpinErr
+	}
+	return err
+}
+
+func (kh *KeyHandler) copyBackup(w io.Writer, size int64, regions []backupRegion) error {
+	//Copies the first size bytes of the file with regions in place of
+	//what's there now. The blocks aren't written in place, and the ones
+	//in use stay so until the copy is done, so only the regions can have
+	//changed since it started
+	var start int64
+	for _, r := range regions {
+		if _, err := io.Copy(w, io.NewSectionReader(kh.bli.file, start, r.start-start)); err != nil {
+			return err
+		}
+		if _, err := w.Write(r.data); err != nil {
+			return err
+		}
+		start = r.start + int64(len(r.data))
+	}
+	_, err := io.Copy(w, io.NewSectionReader(kh.bli.file, start, size-start))
+	return err
+}
+
+//A part of the file that's written in place, as it was when a backup
+//started
+type backupRegion struct {
+	start int64
+	data  []byte
+}
+
+func (kh *KeyHandler) backupRegions() (int64, []backupRegion, error) {
+	//Returns the size of the file and its header, block lists and key
+	//arrays in order. The blocks held for snapshots are free in the copy,
+	//since it has no snapshots to hold them for
+	bli := kh.bli
+	size, err := bli.file.Size()
+	if err != nil {
+		return 0, nil, err
+	}
+	entrySize := int64(binary.Size(blockListArrayEntryData{}))
+	spans := [][2]int64{{0, int64(binary.Size(bli.fileheader))}}
+	for e := bli.Blocklists.Front(); e != nil; e = e.Next() {
+		blm := e.Value.(*blockListManager)
+		spans = append(spans, [2]int64{blm.headerStart, int64(binary.Size(blm.header)) + blm.header.Size*entrySize})
+	}
+	for _, ks := range kh.keySpaces() {
+		for e := ks.keyHeaders.Front(); e != nil; e = e.Next() {
+			block := e.Value.(*keyArrayHeaderInfo).Block.Entry
+			spans = append(spans, [2]int64{block.Start, block.Size})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i][0] < spans[j][0]
+	})
+
+	regions := make([]backupRegion, len(spans))
+	for i, span := range spans {
+		if span[0]+span[1] > size {
+			return 0, nil, fmt.Errorf("backup: Backup: Region at %d is past the end of the file: %w", span[0], ErrCorrupt)
+		}
+		regions[i] = backupRegion{span[0], make([]byte, span[1])}
+		if _, err = bli.file.ReadAt(regions[i].data, span[0]); err != nil {
+			return 0, nil, err
+		}
+	}
+	for _, info := range bli.held {
+		i := sort.Search(len(regions), func(i int) bool {
+			return regions[i].start > info.Location
+		}) - 1
+		if i >= 0 && info.Location < regions[i].start+int64(len(regions[i].data)) {
+			regions[i].data[info.Location-regions[i].start] = 1
+		}
+	}
+	return size, regions, nil
+}
+
+//Same as Backup, but writes the copy to a file at path. The copy is
+//written next to it and renamed once it's complete and synced, so path
+//is never left with part of a backup
+func (kh *KeyHandler) BackupTo(path string) (int64, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	seq, err := kh.Backup(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return seq, err
+}
+
+//Incremental backups start with this header, followed by records that
+//each start with one of the record types below. Strings and values are
+//written as a uvarint length followed by the bytes
+type incrementalHeader struct {
+	Magic   [8]byte
+	Version uint32
+	//the seq the backup was taken since, and the last seq in it
+	Since int64
+	Seq   int64
+}
+
+var incrementalMagic = [8]byte{'g', 'k', 'v', 'l', 'i', 'n', 'c', 'r'}
+
+const incrementalVersion = 2
+
+//The bucket under changeLogParent with the seq of the last incremental
+//backup restored onto the database, see RestoreBackup
+const restoredName = "backup"
+
+const (
+	//the end of the backup
+	recordEnd uint8 = iota
+	//the keys after it are in the bucket at this path, given as the
+	//number of names and then the names. Every bucket has one, parents
+	//before their children, and the KeyHandler's own keys come first
+	recordBucket
+	//a key that hasn't changed, it's only there so that keys that are
+	//missing can be deleted when restoring
+	recordKey
+	//a key and its value
+	recordSet
+	//a key that was deleted, since version 2
+	recordDel
+	//the same as recordBucket, but only the keys that changed are after
+	//it, followed by a recordDel for each one deleted. Since version 2
+	recordChanges
+)
+
+//Writes the keys changed since the write numbered since to w, so that it
+//can be restored onto a backup taken at since with RestoreBackup.
+//Returns the seq to take the next incremental backup since. The seq of
+//a full backup is the Seq of the copy. Values are written as they are,
+//without compression or encryption. With Options.ChangeLog, and as
+//long as the changes since weren't dropped from it, only the keys that
+//were set or deleted are written. Otherwise, and for the keys in
+//buckets, the names of the keys that didn't change are written too, so
+//that deletes can be found. Writes to kh go on while it's written, like
+//for Backup
+func (kh *KeyHandler) BackupSince(w io.Writer, since int64) (int64, error) {
+	seq, buckets, err := kh.pin(since)
+	if err != nil {
+		return 0, err
+	}
+	bw := bufio.NewWriter(w)
+	header := incrementalHeader{incrementalMagic, incrementalVersion, since, seq}
+	err = binary.Write(bw, binary.LittleEndian, header)
+	if err == nil {
+		err = kh.writePinned(bw, buckets)
+	}
+	if err == nil {
+		bw.WriteByte(recordEnd)
+		err = bw.Flush()
+	}
+	return seq, kh.endPin(err)
+}
+
+//A bucket as it was when it was pinned for a backup or dump
+type pinnedBucket struct {
+	path []string
+	//the keys in order, and copies of the entries of the ones changed
+	//since the seq it was pinned at
+	keys    []string
+	changed map[string]keyInfo
+	//keys only has the changed keys, and deleted the ones deleted
+	changes bool
+	deleted []string
+}
+
+func (kh *KeyHandler) pin(since int64) (int64, []*pinnedBucket, error) {
+	//Returns the seq and the buckets of kh, parents before their children
+	//and the KeyHandler's own keys first, keeping the blocks of their
+	//entries from being reused until endPin. A since of -1 has every key
+	//changed
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if kh.closed {
+		return 0, nil, ErrClosed
+	}
+	var buckets []*pinnedBucket
+	var pinBucket func(ks *keySpace, path []string, since int64)
+	pinBucket = func(ks *keySpace, path []string, since int64) {
+		//a bucket that was created or moved since has all its keys
+		//changed
+		if ks.parent != nil {
+			if info := kh.dir.datalocs[dirKey(ks.parent.id(), ks.name)]; info.Seq > since {
+				since = -1
+			}
+		}
+		b := &pinnedBucket{path: path, changed: make(map[string]keyInfo)}
+		if logged := kh.loggedSince(ks, since); logged != nil {
+			b.changes = true
+			for _, key := range logged {
+				if info, ok := ks.datalocs[key]; ok {
+					b.keys = append(b.keys, key)
+					b.changed[key] = *info
+				} else {
+					b.deleted = append(b.deleted, key)
+				}
+			}
+		} else {
+			b.keys, _ = ks.keys()
+			for _, key := range b.keys {
+				if info := ks.datalocs[key]; info.Seq > since {
+					b.changed[key] = *info
+				}
+			}
+		}
+		buckets = append(buckets, b)
+		names, _ := ks.bucketNames()
+		for _, name := range names {
+			pinBucket(ks.children[name], append(path[:len(path):len(path)], name), since)
+		}
+	}
+	pinBucket(&kh.keySpace, nil, since)
+	kh.bli.snapshots++
+	return kh.seq, buckets, nil
+}
+
+func (kh *KeyHandler) loggedSince(ks *keySpace, since int64) []string {
+	//Returns the keys of ks written after since in order, or nil if the
+	//change log doesn't have every write since
+	cl := kh.changes
+	if ks != &kh.keySpace || cl == nil || since < cl.start {
+		return nil
+	}
+	i := sort.Search(len(cl.changes), func(i int) bool {
+		return cl.changes[i].Seq > since
+	})
+	seen := make(map[string]bool)
+	keys := []string{}
+	for _, event := range cl.changes[i:] {
+		if !seen[event.Key] {
+			seen[event.Key] = true
+			keys = append(keys, event.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (kh *KeyHandler) readPinned(info *keyInfo) ([]byte, error) {
+	//Returns the value of a pinned entry. The lock is only held for the
+	//read, so writes to kh go on in between
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	if kh.closed {
+		return nil, ErrClosed
+	}
+	return kh.decodeCopy(info)
+}
+
+func (kh *KeyHandler) writePinned(w *bufio.Writer, buckets []*pinnedBucket) error {
+	//Writes the records for buckets, with a recordKey for each key that
+	//didn't change
+	for _, b := range buckets {
+		if b.changes {
+			w.WriteByte(recordChanges)
+		} else {
+			w.WriteByte(recordBucket)
+		}
+		writeUvarint(w, uint64(len(b.path)))
+		for _, name := range b.path {
+			writeString(w, name)
+		}
+		for _, key := range b.keys {
+			info, ok := b.changed[key]
+			if !ok {
+				w.WriteByte(recordKey)
+				writeString(w, key)
+				continue
+			}
+			data, err := kh.readPinned(&info)
+			if err != nil {
+				return err
+			}
+			w.WriteByte(recordSet)
+			writeString(w, key)
+			writeString(w, string(data))
+		}
+		for _, key := range b.deleted {
+			w.WriteByte(recordDel)
+			writeString(w, key)
+		}
+	}
+	return nil
+}
+
+func writeUvarint(w *bufio.Writer, n uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], n)])
+}
+
+func writeString(w *bufio.Writer, s string) {
+	writeUvarint(w, uint64(len(s)))
+	w.WriteString(s)
+}
+
+//What readString and readPath read from
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readString(r byteReader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	//read in pieces, so a corrupt length fails at the end of r instead
+	//of allocating all of it
+	var sb strings.Builder
+	if _, err = io.CopyN(&sb, r, int64(n)); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+func readPath(r byteReader) ([]string, error) {
+	//Reads the path of a recordBucket
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	var path []string
+	for i := uint64(0); i < n; i++ {
+		name, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, name)
+	}
+	return path, nil
+}
+
+func pathKey(path []string) string {
+	//Returns a map key for a bucket path
+	var buf bytes.Buffer
+	for _, name := range path {
+		var n [binary.MaxVarintLen64]byte
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(len(name)))])
+		buf.WriteString(name)
+	}
+	return buf.String()
+}
+
+//Applies incremental backups taken with BackupSince onto the full
+//backup at path, which is opened with opts. Each one has to be taken
+//since the one before it, or since the full backup for the first, else
+//ErrBackupOrder is returned. The chain can also start from an empty
+//database with a backup taken since 0. The seq of the last one is kept
+//in the database, so a later call goes on with the backup after it as
+//long as the database isn't written to in between
+func RestoreBackup(path string, opts *Options, incrementals ...io.Reader) error {
+	kh, err := OpenWithOptions(path, opts)
+	if err != nil {
+		return err
+	}
+	seq, err := kh.restoredSeq()
+	if err != nil {
+		kh.Close()
+		return err
+	}
+	for _, r := range incrementals {
+		seq, err = kh.restoreIncremental(bufio.NewReader(r), seq)
+		if err == nil {
+			err = kh.setStoredSeq(restoredName, seq)
+		}
+		if err != nil {
+			kh.Close()
+			return err
+		}
+	}
+	if err = kh.bli.file.Sync(); err != nil {
+		kh.Close()
+		return err
+	}
+	return kh.Close()
+}
+
+func (kh *KeyHandler) restoredSeq() (int64, error) {
+	//Returns the seq of the primary the database has the writes up to.
+	//That's the seq of the last incremental backup restored onto it, if
+	//it wasn't written since, else its own seq, which is the primary's
+	//for a full backup
+	seq, written, err := kh.storedSeq(restoredName)
+	if err != nil || written == kh.seq {
+		return seq, err
+	}
+	return kh.seq, nil
+}
+
+func (kh *KeyHandler) restoreIncremental(r *bufio.Reader, seq int64) (int64, error) {
+	//Applies an incremental backup that has to cover the writes after
+	//seq, and returns the seq it goes up to
+	var header incrementalHeader
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return 0, err
+	}
+	switch {
+	case header.Magic != incrementalMagic || header.Version < 1 || header.Version > incrementalVersion:
+		return 0, fmt.Errorf("backup: not an incremental backup: %w", ErrCorrupt)
+	case header.Since > seq || header.Seq < seq:
+		return 0, ErrBackupOrder
+	}
+
+	//keys left out of a recordBucket's records were deleted, and so were
+	//buckets without records. keys is nil after a recordChanges
+	buckets := make(map[string]bool)
+	var store Store
+	var keys map[string]bool
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if keys != nil && (op == recordBucket || op == recordChanges || op == recordEnd) {
+			if err = deleteMissing(store, keys); err != nil {
+				return 0, err
+			}
+		}
+
+		switch op {
+		case recordEnd:
+			return header.Seq, kh.dropMissing(nil, buckets)
+		case recordBucket, recordChanges:
+			path, err := readPath(r)
+			if err != nil {
+				return 0, err
+			}
+			buckets[pathKey(path)] = true
+			keys = nil
+			if op == recordBucket {
+				keys = make(map[string]bool)
+			}
+			if store, err = kh.restoreBucket(path); err != nil {
+				return 0, err
+			}
+		case recordKey, recordSet, recordDel:
+			if store == nil {
+				return 0, fmt.Errorf("backup: key before the first bucket: %w", ErrCorrupt)
+			}
+			key, err := readString(r)
+			if err != nil {
+				return 0, err
+			}
+			if keys != nil {
+				keys[key] = true
+			}
+			switch op {
+			case recordKey:
+				continue
+			case recordDel:
+				if _, err = store.Del(key); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			value, err := readString(r)
+			if err != nil {
+				return 0, err
+			}
+			if err = store.Set(key, []byte(value)); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("backup: unknown record %d: %w", op, ErrCorrupt)
+		}
+	}
+}
+
+func (kh *KeyHandler) restoreBucket(path []string) (Store, error) {
+	//Returns the bucket at path, creating it if it doesn't exist, or kh
+	//for an empty path
+	if len(path) == 0 {
+		return kh, nil
+	}
+	b, err := kh.CreateBucket(path...)
+	if err == ErrBucketExists {
+		return kh.Bucket(path...)
+	}
+	return b, err
+}
+
+func deleteMissing(store Store, keys map[string]bool) error {
+	//Deletes the keys of store that aren't in keys
+	all, err := store.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range all {
+		if keys[key] {
+			continue
+		}
+		if _, err = store.Del(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kh *KeyHandler) dropMissing(path []string, buckets map[string]bool) error {
+	//Drops the buckets under path that aren't in buckets
+	var names []string
+	var err error
+	if len(path) == 0 {
+		names, err = kh.Buckets()
+	} else {
+		var b *Bucket
+		if b, err = kh.Bucket(path...); err == nil {
+			names, err = b.Buckets()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		child := append(path[:len(path):len(path)], name)
+		if buckets[pathKey(child)] {
+			err = kh.dropMissing(child, buckets)
+		} else {
+			err = kh.DropBucket(child...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
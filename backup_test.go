@@ -0,0 +1,339 @@
+package gokvlite
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	kh, err := OpenStorage(NewMemStorage(), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	const keys = 100
+	for i := 0; i < keys; i++ {
+		if err = kh.Set(fmt.Sprintf("key%d", i), []byte("0")); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	//every key has some round's value in a backup taken while writing,
+	//larger ones so that the writes move blocks around
+	done := make(chan error)
+	go func() {
+		for round := 1; round <= 20; round++ {
+			value := []byte(strconv.Itoa(round) + string(make([]byte, round*10)))
+			for i := 0; i < keys; i++ {
+				if err := kh.Set(fmt.Sprintf("key%d", i), value); err != nil {
+					done <- err
+					return
+				}
+			}
+		}
+		done <- nil
+	}()
+	for n := 0; n < 10; n++ {
+		var buf bytes.Buffer
+		seq, err := kh.Backup(&buf)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		ms := NewMemStorage()
+		ms.WriteAt(buf.Bytes(), 0)
+		backup, err := OpenStorage(ms, nil)
+		if err != nil {
+			t.Fatalf("Opening backup %d: %v", n, err)
+		}
+		if backup.Seq() != seq {
+			t.Fatalf("Incorrect seq for backup %d: %d, expected %d", n, seq, backup.Seq())
+		}
+		for i := 0; i < keys; i++ {
+			data, found, err := backup.Get(fmt.Sprintf("key%d", i))
+			if err != nil || !found || len(data) == 0 {
+				t.Fatalf("Incorrect data in backup %d for key%d: %v %v", n, i, found, err)
+			}
+		}
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	tempfile := "/tmp/gotest_backup"
+	os.Remove(tempfile)
+	if _, err = kh.BackupTo(tempfile); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	backup, err := OpenWithOptions(tempfile, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer backup.Close()
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key%d", i)
+		want, _, _ := kh.Get(key)
+		if data, _, err := backup.Get(key); err != nil || !bytes.Equal(data, want) {
+			t.Fatalf("Incorrect data in the backup file for %s: %v", key, err)
+		}
+	}
+}
+
+//Writes to kh whenever the backup is written to, which would block
+//forever if Backup kept writes waiting
+type writingWriter struct {
+	buf    bytes.Buffer
+	kh     *KeyHandler
+	writes int
+	err    error
+}
+
+func (w *writingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	key := fmt.Sprintf("key%d", w.writes%10)
+	if w.err == nil {
+		w.err = w.kh.Set(key, []byte(strings.Repeat("b", 100+w.writes)))
+	}
+	if w.err == nil {
+		_, w.err = w.kh.Del(fmt.Sprintf("key%d", w.writes%10+10))
+	}
+	return w.buf.Write(p)
+}
+
+func TestBackupWriting(t *testing.T) {
+	kh, err := OpenStorage(NewMemStorage(), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	want := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		want[key] = strings.Repeat("a", 100+i)
+		if err = kh.Set(key, []byte(want[key])); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	//the blocks freed from now on are held, and aren't used in the copy
+	s, err := kh.Snapshot()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("key%d", i)
+		want[key] = strings.Repeat("c", 100+i)
+		if err = kh.Set(key, []byte(want[key])); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if len(kh.bli.held) == 0 {
+		t.Fatalf("No blocks were held for the snapshot")
+	}
+
+	w := &writingWriter{kh: kh}
+	if _, err = kh.Backup(w); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if w.err != nil || w.writes == 0 {
+		t.Fatalf("Writing during the backup: %d %v", w.writes, w.err)
+	}
+	ms := NewMemStorage()
+	ms.WriteAt(w.buf.Bytes(), 0)
+	backup, err := OpenStorage(ms, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if unused := backup.unreferenced(); len(unused) != 0 {
+		t.Fatalf("%d used blocks in the backup aren't referenced", len(unused))
+	}
+	checkValues(t, backup, want)
+
+	if err = s.Release(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(kh.bli.held) != 0 || kh.bli.snapshots != 0 {
+		t.Fatalf("Blocks still held after the backup and snapshot: %d", len(kh.bli.held))
+	}
+}
+
+func TestIncrementalBackupWriting(t *testing.T) {
+	kh, err := OpenStorage(NewMemStorage(), &Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if err = kh.Set(fmt.Sprintf("key%d", i), []byte("a")); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	var full bytes.Buffer
+	since, err := kh.Backup(&full)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	//enough to be written out in pieces, with writes in between
+	for i := 0; i < 20; i++ {
+		if err = kh.Set(fmt.Sprintf("key%d", i), []byte(strings.Repeat("c", 1000))); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	want := dumpAll(t, kh)
+
+	w := &writingWriter{kh: kh}
+	if _, err = kh.BackupSince(w, since); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if w.err != nil || w.writes < 2 {
+		t.Fatalf("Writing during the backup: %d %v", w.writes, w.err)
+	}
+	ms := NewMemStorage()
+	ms.WriteAt(full.Bytes(), 0)
+	backup, err := OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = backup.restoreIncremental(bufio.NewReader(&w.buf), since); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if got := dumpAll(t, backup); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Restored backup is\n%v\nexpected\n%v", got, want)
+	}
+	if kh.bli.snapshots != 0 || len(kh.bli.held) != 0 {
+		t.Fatalf("Blocks still held after the backup: %d", len(kh.bli.held))
+	}
+}
+
+func dumpAll(t *testing.T, kh *KeyHandler) map[string]string {
+	//Returns every key and value, with the path of the bucket it's in
+	dump := make(map[string]string)
+	var walk func(path ...string)
+	walk = func(path ...string) {
+		var store Store = kh
+		names, err := kh.Buckets()
+		if len(path) > 0 {
+			b, _ := kh.Bucket(path...)
+			store = b
+			names, err = b.Buckets()
+		}
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		prefix := strings.Join(path, "/") + "/"
+		err = store.ForEach(func(key string, data []byte) error {
+			dump[prefix+key] = string(data)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		for _, name := range names {
+			dump[prefix+name+"/"] = ""
+			walk(append(path[:len(path):len(path)], name)...)
+		}
+	}
+	walk()
+	return dump
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	for _, opts := range []*Options{nil, {ChangeLog: true}} {
+		testIncrementalBackup(t, opts)
+	}
+}
+
+func testIncrementalBackup(t *testing.T, opts *Options) {
+	tempfile := "/tmp/gotest_incremental"
+	os.Remove(tempfile)
+	kh, err := OpenWithOptions(tempfile, opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer kh.Close()
+	set := func(store Store, key string, value string) {
+		if err := store.Set(key, []byte(value)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		set(kh, key, "value-"+key)
+	}
+	b1, _ := kh.CreateBucket("b1")
+	set(b1, "x", "value-x")
+	b2, _ := kh.CreateBucket("b1", "b2")
+	set(b2, "y", "value-y")
+	kh.CreateBucket("b3")
+
+	full := []string{"/tmp/gotest_full1", "/tmp/gotest_full2"}
+	for _, path := range full {
+		if _, err = kh.BackupTo(path); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	backup, err := Open(full[0])
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	since := backup.Seq()
+	backup.Close()
+
+	//more writes than restoring takes, so the seqs of the backup and of
+	//the primary differ
+	for i := 0; i < 5; i++ {
+		set(kh, "a", "changed-a")
+	}
+	kh.Del("b")
+	set(kh, "d", "value-d")
+	set(b1, "z", "value-z")
+	kh.DropBucket("b3")
+	var inc1 bytes.Buffer
+	since, err = kh.BackupSince(&inc1, since)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if bytes.Contains(inc1.Bytes(), []byte("value-c")) || !bytes.Contains(inc1.Bytes(), []byte("changed-a")) {
+		t.Fatalf("Incremental backup doesn't have only the changed values")
+	}
+	//with the change log the keys that didn't change aren't listed, and
+	//the deletes are written instead
+	unchanged := bytes.Contains(inc1.Bytes(), []byte{recordKey, 1, 'c'})
+	deleted := bytes.Contains(inc1.Bytes(), []byte{recordDel, 1, 'b'})
+	if opts != nil && (unchanged || !deleted) || opts == nil && (!unchanged || deleted) {
+		t.Fatalf("Incorrect records for the keys that didn't change: %v %v", unchanged, deleted)
+	}
+
+	kh.Del("d")
+	kh.RenameBucket("b1", "b4")
+	b4, _ := kh.Bucket("b4")
+	kh.CreateBucket("b4", "b5")
+	set(b4, "x", "changed-x")
+	var inc2 bytes.Buffer
+	if _, err = kh.BackupSince(&inc2, since); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if err = RestoreBackup(full[1], nil, bytes.NewReader(inc2.Bytes())); err != ErrBackupOrder {
+		t.Fatalf("Restored an incremental backup out of order: %v", err)
+	}
+	//one at a time, so the next one has to follow the one restored before
+	for _, inc := range []*bytes.Buffer{&inc1, &inc2} {
+		if err = RestoreBackup(full[1], nil, bytes.NewReader(inc.Bytes())); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if err = RestoreBackup(full[0], nil, &inc1, &inc2); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, path := range full {
+		backup, err = Open(path)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		want, got := dumpAll(t, kh), dumpAll(t, backup)
+		backup.Close()
+		if fmt.Sprint(want) != fmt.Sprint(got) {
+			t.Fatalf("Restored backup %s is\n%v\nexpected\n%v", path, got, want)
+		}
+	}
+}
@@ -1,34 +1,249 @@
 package gokvlite
 
 import (
+	"errors"
+	"fmt"
 	"os"
 )
 
+var (
+	//Returned when reading a key that doesn't exist
+	ErrNotFound = errors.New("gokvlite: key not found")
+	//Returned when the file doesn't contain what's expected
+	ErrCorrupt = errors.New("gokvlite: database is corrupt")
+	//Returned when using a KeyHandler after Close
+	ErrClosed = errors.New("gokvlite: database is closed")
+	//Returned when writing to a database opened read only
+	ErrReadOnly = errors.New("gokvlite: database is read only")
+	//Returned when a key is longer than the maximum key size. The error
+	//returned is a KeyTooLargeError, so check for it with errors.Is
+	ErrKeyTooLarge = errors.New("gokvlite: key is too large")
+	//Returned when using a bucket that doesn't exist or was dropped
+	ErrBucketNotFound = errors.New("gokvlite: bucket not found")
+	//Returned when creating a bucket, or renaming one, to a name that's
+	//already taken
+	ErrBucketExists = errors.New("gokvlite: bucket already exists")
+	//Returned when using an index that isn't registered
+	ErrIndexNotFound = errors.New("gokvlite: index not found")
+	//Returned when querying an index that has to be rebuilt first
+	ErrIndexStale = errors.New("gokvlite: index is out of date")
+	//Returned when opening an encrypted database without its key, or
+	//with the wrong one
+	ErrWrongKey = errors.New("gokvlite: wrong encryption key")
+	//Returned by Rekey while a Snapshot is open or a Backup runs
+	ErrSnapshotOpen = errors.New("gokvlite: snapshot is open")
+	//Returned by RestoreBackup when an incremental backup wasn't taken
+	//since the backup before it
+	ErrBackupOrder = errors.New("gokvlite: incremental backup is out of order")
+	//Returned by Watcher.Err when the Watcher fell too far behind the
+	//writes and was closed
+	ErrWatchOverflow = errors.New("gokvlite: watcher fell behind")
+	//Returned by ChangesSince when the database wasn't opened with
+	//Options.ChangeLog
+	ErrChangeLogOff = errors.New("gokvlite: change log is off")
+	//Returned when reading changes that were already dropped from the
+	//change log
+	ErrChangesTrimmed = errors.New("gokvlite: changes are no longer in the log")
+	//Returned by Follow when the database wasn't opened with
+	//Options.Follower
+	ErrNotFollower = errors.New("gokvlite: database isn't a follower")
+	//Returned by OpenSharded when there are shards for another number
+	//of shards, which have to be moved with Reshard first
+	ErrShardCount = errors.New("gokvlite: sharded store has a different number of shards")
+	//Returned by a reader from GetReader once the key it reads was
+	//written to or deleted, since the blocks it reads can be reused
+	ErrValueChanged = errors.New("gokvlite: value changed while reading")
+	//Returned when opening a file from before the file format had a
+	//version, which has to be converted with Upgrade first
+	ErrOldFormat = errors.New("gokvlite: database is in an older file format")
+)
+
+//Returned when a key is longer than the maximum key size
+type KeyTooLargeError struct {
+	Size    int
+	MaxSize int
+}
+
+func (e *KeyTooLargeError) Error() string {
+	return fmt.Sprintf("gokvlite: key is too large: %d bytes, the maximum is %d", e.Size, e.MaxSize)
+}
+
+//Makes errors.Is(err, ErrKeyTooLarge) true
+func (e *KeyTooLargeError) Is(target error) bool {
+	return target == ErrKeyTooLarge
+}
+
+//Options changes how a database is opened. The zero value is the
+//same as calling Open
+type Options struct {
+	//Opens the file read only. The file has to exist already and
+	//writes fail with ErrReadOnly
+	ReadOnly bool
+	//Reads values through a memory mapping of the file instead of a
+	//read syscall per Get. Writes still go through the file. Only
+	//supported on Linux
+	Mmap bool
+	//Skips the syncs that keep the file consistent if the machine
+	//crashes or loses power, which cost several fsyncs per write and
+	//make writes many times slower. Without them such a crash can leave
+	//the file corrupt, but the process exiting still can't
+	NoSync bool
+	//Keeps up to this many bytes of recently read values in memory.
+	//0 turns the cache off. Values that fit in the key entry with
+	//their key are always in memory and aren't counted
+	CacheSize int64
+	//Compresses values written with Set. Values that can be read
+	//don't depend on this, see RegisterCompressor
+	Compressor Compressor
+	//Values shorter than this are stored as they are. 0 means 128 bytes
+	CompressMinSize int
+	//Keys longer than this are rejected with a KeyTooLargeError. 0
+	//means 65535 bytes. It's only checked when writing, so it can be
+	//changed between opens
+	MaxKeySize int
+	//Encrypts values with AES-GCM using this key, which has to be 16,
+	//24 or 32 bytes long. Once a database has a key, opening it needs
+	//the same key, see Rekey for changing it
+	EncryptionKey []byte
+	//Also encrypts keys written from now on. Keys are still kept in
+	//memory as plain text while the database is open. The keys of
+	//indexes are values, so they're encrypted either way
+	EncryptKeys bool
+	//The key used before an interrupted Rekey, so the values it didn't
+	//get to can still be read
+	PreviousEncryptionKey []byte
+	//Keeps up to this many earlier versions of each key, including
+	//deletes, for GetAt and History. -1 keeps all of them, see
+	//PruneVersions. Keys in buckets only have their current value.
+	//Without it, the versions already in the file are still kept, and
+	//the keys they're of still get new ones, until PruneVersions frees
+	//them
+	KeepVersions int
+	//How many events a Watcher can fall behind by before it's closed.
+	//0 means 1024
+	WatchBuffer int
+	//Keeps a log of the writes to the keys of the KeyHandler in the
+	//file, for ChangesSince. Keys in buckets aren't included. Once the
+	//file has a log it's kept up to date without this too, until
+	//DropChangeLog. The log is also kept in memory, so it's limited by
+	//ChangeLogSize
+	ChangeLog bool
+	//Drops the oldest changes once the log has more than this many. 0
+	//doesn't limit the count
+	ChangeLogCount int
+	//Drops the oldest changes once the log takes more than this many
+	//bytes, counting its entries in the file and the keys of the copy
+	//of it kept in memory. 0 means 64 MiB, -1 doesn't limit the size
+	ChangeLogSize int64
+	//Opens the database as a follower of a primary, see Follow. Writes
+	//other than the ones Follow applies fail with ErrReadOnly
+	Follower bool
+}
+
 //Opens a file to be used as a database. If the file doesn't exist,
 //it'll create it and initialize it.
 func Open(filename string) (*KeyHandler, error) {
-	_, bli, err := readFile(filename)
+	return OpenWithOptions(filename, nil)
+}
+
+//Same as Open, but with options. opts may be nil
+func OpenWithOptions(filename string, opts *Options) (*KeyHandler, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if opts != nil && opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(filename, flag, os.FileMode(0666))
 	if err != nil {
-		if e, ok := err.(*os.PathError); ok && (os.IsNotExist(e)) {
-			//file doesn't exist, create
-			_, bli, err = newFile(filename)
-			if err != nil {
-				return nil, err
-			}
+		return nil, err
+	}
 
-			var kh KeyHandler
-			kh.bli = bli
-			kh.datalocs = make(map[string]*keyInfo)
+	kh, err := OpenStorage(FileStorage{file}, opts)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return kh, nil
+}
 
-			err = kh.makeNewList()
-			return &kh, err
-		} else {
-			return nil, err
-		}
+//Opens a database kept in storage. If storage is empty, it'll be
+//initialized. opts may be nil
+func OpenStorage(storage Storage, opts *Options) (*KeyHandler, error) {
+	if opts == nil {
+		opts = new(Options)
+	}
+	size, err := storage.Size()
+	if err != nil {
+		return nil, err
 	}
+
 	var kh KeyHandler
-	kh.bli = bli
-	kh.datalocs = make(map[string]*keyInfo)
-	err = kh.readFile(bli.fileheader.Data_start)
-	return &kh, err
+	kh.readOnly = opts.ReadOnly
+	if opts.CacheSize > 0 {
+		kh.cache = newValueCache(opts.CacheSize)
+	}
+	kh.compressor = opts.Compressor
+	kh.compressMin = opts.CompressMinSize
+	if kh.compressMin == 0 {
+		kh.compressMin = defaultCompressMinSize
+	}
+	kh.maxKeySize = opts.MaxKeySize
+	if kh.maxKeySize == 0 {
+		kh.maxKeySize = maxKeySize
+	}
+	kh.watchBuffer = opts.WatchBuffer
+	if kh.watchBuffer == 0 {
+		kh.watchBuffer = defaultWatchBuffer
+	}
+
+	if size == 0 {
+		if opts.ReadOnly {
+			return nil, ErrCorrupt
+		}
+		kh.bli, err = newStorage(storage)
+	} else {
+		kh.bli, err = readStorage(storage)
+		if err == errUninitialized {
+			if opts.ReadOnly {
+				return nil, ErrCorrupt
+			}
+			kh.bli, err = newStorage(storage)
+		}
+	}
+	if err == nil {
+		kh.bli.noSync = opts.NoSync
+		err = kh.setEncryption(opts)
+	}
+	if err == nil {
+		kh.initKeySpace(&kh.keySpace, &kh.bli.fileheader.Data_start)
+		kh.seq = kh.bli.fileheader.Seq
+		kh.keepVersions = opts.KeepVersions
+		kh.history = make(map[string][]*keyInfo)
+		starts := kh.bli.usedStarts()
+		err = kh.readFile(kh.bli.fileheader.Data_start, starts)
+		if err == nil {
+			err = kh.readBuckets(starts)
+		}
+		if err == nil {
+			err = kh.readHistory()
+		}
+	}
+	if err == nil && kh.keyHeaders.Len() == 0 && !opts.ReadOnly {
+		//a new file, or creating was interrupted before the first key list
+		err = kh.makeNewList()
+	}
+	if err == nil {
+		err = kh.readChangeLog(opts)
+	}
+	if err == nil && !opts.ReadOnly {
+		err = kh.reclaim()
+	}
+	//set last, since opening can write
+	kh.follower = opts.Follower
+	if err == nil {
+		err = kh.setMmap(opts.Mmap)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &kh, nil
 }
@@ -0,0 +1,490 @@
+package gokvlite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+)
+
+//The bucket directory is a keySpace of its own, rooted at
+//Buckets_start in the file header. Its keys are the id of the parent
+//bucket followed by the bucket name, see dirKey, and its values are
+//bucketEntries
+type bucketEntry struct {
+	//the first key array of the bucket
+	Keys int64
+}
+
+//A Bucket is a set of keys kept apart from the keys of the KeyHandler
+//and of other buckets in the same file. It has the same methods for
+//reading and writing keys as KeyHandler, and can hold buckets of its
+//own. A Bucket stays valid when it's renamed, and fails with
+//ErrBucketNotFound once it or a bucket it's in is dropped
+type Bucket struct {
+	ks *keySpace
+}
+
+func (ks *keySpace) id() int64 {
+	//Returns what the directory keys of the children of ks start with.
+	//It's where the first key array of ks is, which never changes, or 0
+	//for the top level buckets
+	if ks.parent == nil {
+		return ks.topID
+	}
+	return ks.keyHeaders.Front().Value.(*keyArrayHeaderInfo).Location
+}
+
+func dirKey(parent int64, name string) string {
+	key := make([]byte, 8, 8+len(name))
+	binary.LittleEndian.PutUint64(key, uint64(parent))
+	return string(append(key, name...))
+}
+
+func (ks *keySpace) subtree() []*keySpace {
+	//Returns ks and every bucket under it, children before their parents
+	var spaces []*keySpace
+	for _, child := range ks.children {
+		spaces = append(spaces, child.subtree()...)
+	}
+	return append(spaces, ks)
+}
+
+func (kh *KeyHandler) keySpaces() []*keySpace {
+	//Returns the keySpace of the KeyHandler, the bucket directory, the
+	//buckets and the indexes
+	spaces := append(kh.keySpace.subtree(), kh.indexRoot.subtree()...)
+	spaces = append(spaces, kh.changeRoot.subtree()...)
+	if kh.dir != nil {
+		spaces = append(spaces, kh.dir)
+	}
+	return spaces
+}
+
+func (kh *KeyHandler) readBuckets(starts map[int64]*blockListInfo) error {
+	//Reads the bucket directory and builds the tree of buckets in it
+	kh.indexRoot = kh.newKeySpace(nil)
+	kh.indexRoot.topID = indexParent
+	kh.indexes = make(map[string]*index)
+	kh.changeRoot = kh.newKeySpace(nil)
+	kh.changeRoot.topID = changeLogParent
+	header := kh.bli.fileheader
+	if header.Buckets_start == 0 {
+		return nil
+	}
+	kh.dir = kh.newKeySpace(&header.Buckets_start)
+	err := kh.dir.readFile(header.Buckets_start, starts)
+	if err != nil {
+		return err
+	}
+
+	keys, _ := kh.dir.keys()
+	byID := map[int64]*keySpace{0: &kh.keySpace, indexParent: kh.indexRoot, changeLogParent: kh.changeRoot}
+	parents := make(map[*keySpace]int64)
+	for _, key := range keys {
+		data, _, err := kh.dir.get(key)
+		if err != nil {
+			return err
+		}
+		var entry bucketEntry
+		err = binary.Read(bytes.NewReader(data), binary.LittleEndian, &entry)
+		if err != nil || len(key) < 8 {
+			return fmt.Errorf("bucket: readBuckets: Invalid entry %q: %w", key, ErrCorrupt)
+		}
+		if byID[entry.Keys] != nil {
+			//a rename was interrupted after the new name was written,
+			//but before the old one was deleted. Either one is valid
+			if err = kh.dropDirEntry(key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		ks := kh.newKeySpace(nil)
+		err = ks.readFile(entry.Keys, starts)
+		if err != nil {
+			return err
+		}
+		if ks.keyHeaders.Len() == 0 {
+			return fmt.Errorf("bucket: readBuckets: No key array for %q: %w", key, ErrCorrupt)
+		}
+		ks.name = key[8:]
+		byID[entry.Keys] = ks
+		parents[ks] = int64(binary.LittleEndian.Uint64([]byte(key)))
+	}
+
+	for ks, id := range parents {
+		if parent := byID[id]; parent != nil && parent != ks {
+			ks.parent = parent
+			parent.children[ks.name] = ks
+		}
+	}
+	//Drops shouldn't leave buckets without a parent, but if there are
+	//any they can't be reached, so they're taken out of the directory
+	reachable := make(map[*keySpace]bool)
+	for _, ks := range kh.keySpaces() {
+		reachable[ks] = true
+	}
+	for ks, id := range parents {
+		if !reachable[ks] {
+			if err = kh.dropDirEntry(dirKey(id, ks.name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (kh *KeyHandler) dropDirEntry(key string) error {
+	//Deletes a directory entry found to be invalid when opening. Its
+	//blocks are leaked, since another entry may be using them
+	if kh.readOnly {
+		return nil
+	}
+	_, err := kh.dir.del(key)
+	return err
+}
+
+func (kh *KeyHandler) writeBucket(parent int64, name string, ks *keySpace) error {
+	//Points name under parent in the directory at the key arrays of ks
+	first := ks.keyHeaders.Front().Value.(*keyArrayHeaderInfo)
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, bucketEntry{first.Location})
+	if kh.dir == nil {
+		kh.dir = kh.newKeySpace(&kh.bli.fileheader.Buckets_start)
+	}
+	return kh.dir.set(dirKey(parent, name), buf.Bytes())
+}
+
+func (ks *keySpace) checkBucket(name string) error {
+	//Returns the error changing the bucket called name in ks should fail
+	//with, if any
+	if err := ks.checkWrite(name); err != nil {
+		return err
+	}
+	//directory keys start with the id of the parent
+	if max := ks.kh.maxKeySize - 8; len(name) > max {
+		return &KeyTooLargeError{len(name), max}
+	}
+	return nil
+}
+
+func (ks *keySpace) bucket(name string) (*Bucket, error) {
+	switch {
+	case ks.kh.closed:
+		return nil, ErrClosed
+	case ks.dropped:
+		return nil, ErrBucketNotFound
+	}
+	child, ok := ks.children[name]
+	if !ok {
+		return nil, ErrBucketNotFound
+	}
+	return &Bucket{child}, nil
+}
+
+func (ks *keySpace) createBucket(name string) (*Bucket, error) {
+	kh := ks.kh
+	if err := ks.checkBucket(name); err != nil {
+		return nil, err
+	}
+	if _, ok := ks.children[name]; ok {
+		return nil, ErrBucketExists
+	}
+
+	//The key array is written before the directory points at it. If
+	//writing the directory fails, the array is leaked
+	child := kh.newKeySpace(nil)
+	if err := child.makeNewList(); err != nil {
+		return nil, err
+	}
+	if err := kh.writeBucket(ks.id(), name, child); err != nil {
+		return nil, err
+	}
+	child.name = name
+	child.parent = ks
+	ks.children[name] = child
+	return &Bucket{child}, nil
+}
+
+func (ks *keySpace) dropBucket(name string) error {
+	kh := ks.kh
+	if err := ks.checkBucket(name); err != nil {
+		return err
+	}
+	child, ok := ks.children[name]
+	if !ok {
+		return ErrBucketNotFound
+	}
+
+	//Every bucket in the subtree is taken out of the directory, children
+	//first so that a failure leaves their parents, and then their blocks
+	//are freed. If a write fails, the blocks are leaked rather than freed
+	subtree := child.subtree()
+	var err error
+	for _, b := range subtree {
+		if err == nil {
+			_, err = kh.dir.del(dirKey(b.parent.id(), b.name))
+		}
+	}
+	delete(ks.children, name)
+	for _, b := range subtree {
+		b.dropped = true
+		if kh.cache != nil {
+			kh.cache.removePrefix(b.cacheID)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, b := range subtree {
+		if err = b.free(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ks *keySpace) renameBucket(oldName string, newName string) error {
+	kh := ks.kh
+	if err := ks.checkBucket(newName); err != nil {
+		return err
+	}
+	child, ok := ks.children[oldName]
+	if !ok {
+		return ErrBucketNotFound
+	}
+	if oldName == newName {
+		return nil
+	}
+	if _, ok = ks.children[newName]; ok {
+		return ErrBucketExists
+	}
+
+	//The new name is written before the old one is deleted. If it fails
+	//in between, opening the file again keeps one of them. The buckets
+	//in it don't change, since they're found by the id of the bucket
+	if err := kh.writeBucket(ks.id(), newName, child); err != nil {
+		return err
+	}
+	child.name = newName
+	ks.children[newName] = child
+	delete(ks.children, oldName)
+	_, err := kh.dir.del(dirKey(ks.id(), oldName))
+	return err
+}
+
+func (ks *keySpace) bucketNames() ([]string, error) {
+	switch {
+	case ks.kh.closed:
+		return nil, ErrClosed
+	case ks.dropped:
+		return nil, ErrBucketNotFound
+	}
+	names := make([]string, 0, len(ks.children))
+	for name := range ks.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (kh *KeyHandler) walk(path []string) (*keySpace, error) {
+	//Returns the bucket at path, or the KeyHandler's own keySpace for an
+	//empty path
+	if kh.closed {
+		return nil, ErrClosed
+	}
+	ks := &kh.keySpace
+	for _, name := range path {
+		child, ok := ks.children[name]
+		if !ok {
+			return nil, ErrBucketNotFound
+		}
+		ks = child
+	}
+	return ks, nil
+}
+
+//Returns the bucket at path, where each name is a bucket inside the one
+//before. Returns ErrBucketNotFound if there isn't one
+func (kh *KeyHandler) Bucket(path ...string) (*Bucket, error) {
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	if len(path) == 0 {
+		return nil, ErrBucketNotFound
+	}
+	parent, err := kh.walk(path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	return parent.bucket(path[len(path)-1])
+}
+
+//Creates an empty bucket at path. The buckets it's in have to exist
+//already, otherwise it returns ErrBucketNotFound. Returns
+//ErrBucketExists if there's already one
+func (kh *KeyHandler) CreateBucket(path ...string) (*Bucket, error) {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if len(path) == 0 {
+		return nil, ErrBucketNotFound
+	}
+	parent, err := kh.walk(path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	return parent.createBucket(path[len(path)-1])
+}
+
+//Deletes the bucket at path along with all its keys and the buckets in
+//it, freeing the space they used. Returns ErrBucketNotFound if there
+//isn't one
+func (kh *KeyHandler) DropBucket(path ...string) error {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if len(path) == 0 {
+		return ErrBucketNotFound
+	}
+	parent, err := kh.walk(path[:len(path)-1])
+	if err != nil {
+		return err
+	}
+	return parent.dropBucket(path[len(path)-1])
+}
+
+//Renames the top level bucket called oldName to newName. Returns
+//ErrBucketNotFound if there isn't one, or ErrBucketExists if newName is
+//taken
+func (kh *KeyHandler) RenameBucket(oldName string, newName string) error {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if kh.closed {
+		return ErrClosed
+	}
+	return kh.renameBucket(oldName, newName)
+}
+
+//Returns the names of the top level buckets in order
+func (kh *KeyHandler) Buckets() ([]string, error) {
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	return kh.bucketNames()
+}
+
+//Returns the bucket called name inside b, or ErrBucketNotFound if there
+//isn't one
+func (b *Bucket) Bucket(name string) (*Bucket, error) {
+	b.ks.kh.lock.RLock()
+	defer b.ks.kh.lock.RUnlock()
+	return b.ks.bucket(name)
+}
+
+//Same as KeyHandler.CreateBucket, for a bucket inside b
+func (b *Bucket) CreateBucket(name string) (*Bucket, error) {
+	b.ks.kh.lock.Lock()
+	defer b.ks.kh.lock.Unlock()
+	return b.ks.createBucket(name)
+}
+
+//Same as KeyHandler.DropBucket, for a bucket inside b
+func (b *Bucket) DropBucket(name string) error {
+	b.ks.kh.lock.Lock()
+	defer b.ks.kh.lock.Unlock()
+	return b.ks.dropBucket(name)
+}
+
+//Same as KeyHandler.RenameBucket, for a bucket inside b
+func (b *Bucket) RenameBucket(oldName string, newName string) error {
+	b.ks.kh.lock.Lock()
+	defer b.ks.kh.lock.Unlock()
+	return b.ks.renameBucket(oldName, newName)
+}
+
+//Returns the names of the buckets inside b in order
+func (b *Bucket) Buckets() ([]string, error) {
+	b.ks.kh.lock.RLock()
+	defer b.ks.kh.lock.RUnlock()
+	return b.ks.bucketNames()
+}
+
+//Sets the key to data
+func (b *Bucket) Set(key string, data []byte) error {
+	b.ks.kh.lock.Lock()
+	defer b.ks.kh.lock.Unlock()
+	return b.ks.set(key, data)
+}
+
+//Same as KeyHandler.SetFromReader
+func (b *Bucket) SetFromReader(key string, r io.Reader, size int64) error {
+	b.ks.kh.lock.Lock()
+	defer b.ks.kh.lock.Unlock()
+	return b.ks.setFromReader(key, r, size)
+}
+
+//Gets the data contained at key. found is false if the key doesn't exist
+func (b *Bucket) Get(key string) (data []byte, found bool, err error) {
+	b.ks.kh.lock.RLock()
+	defer b.ks.kh.lock.RUnlock()
+	return b.ks.get(key)
+}
+
+//Same as KeyHandler.GetInto
+func (b *Bucket) GetInto(key string, dst []byte) ([]byte, error) {
+	b.ks.kh.lock.RLock()
+	defer b.ks.kh.lock.RUnlock()
+	return b.ks.getInto(key, dst)
+}
+
+//Same as KeyHandler.View
+func (b *Bucket) View(key string, fn func(data []byte) error) error {
+	b.ks.kh.lock.RLock()
+	defer b.ks.kh.lock.RUnlock()
+	return b.ks.view(key, fn)
+}
+
+//Same as KeyHandler.GetReader
+func (b *Bucket) GetReader(key string) (*io.SectionReader, error) {
+	b.ks.kh.lock.RLock()
+	defer b.ks.kh.lock.RUnlock()
+	return b.ks.getReader(key)
+}
+
+//Deletes the key if it exists. existed is false if it didn't
+func (b *Bucket) Del(key string) (existed bool, err error) {
+	b.ks.kh.lock.Lock()
+	defer b.ks.kh.lock.Unlock()
+	return b.ks.del(key)
+}
+
+//Same as KeyHandler.SetBytes
+func (b *Bucket) SetBytes(key []byte, data []byte) error {
+	return b.Set(string(key), data)
+}
+
+//Same as KeyHandler.GetBytes
+func (b *Bucket) GetBytes(key []byte) (data []byte, found bool, err error) {
+	b.ks.kh.lock.RLock()
+	defer b.ks.kh.lock.RUnlock()
+	return b.ks.get(bytesKey(key))
+}
+
+//Same as KeyHandler.DelBytes
+func (b *Bucket) DelBytes(key []byte) (existed bool, err error) {
+	return b.Del(string(key))
+}
+
+//Returns all the keys in the bucket in order
+func (b *Bucket) Keys() ([]string, error) {
+	b.ks.kh.lock.RLock()
+	defer b.ks.kh.lock.RUnlock()
+	return b.ks.keys()
+}
+
+//Same as KeyHandler.ForEach, for the keys in the bucket
+func (b *Bucket) ForEach(fn func(key string, data []byte) error) error {
+	b.ks.kh.lock.RLock()
+	defer b.ks.kh.lock.RUnlock()
+	return b.ks.forEach(fn)
+}
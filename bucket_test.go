@@ -0,0 +1,356 @@
+package gokvlite
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBuckets(t *testing.T) {
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.Bucket("users"); err != ErrBucketNotFound {
+		t.Fatalf("Expected ErrBucketNotFound: %v", err)
+	}
+	users, err := kh.CreateBucket("users")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.CreateBucket("users"); err != ErrBucketExists {
+		t.Fatalf("Expected ErrBucketExists: %v", err)
+	}
+	orders, err := kh.CreateBucket("orders")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//the same key in each bucket and the KeyHandler is separate
+	kh.Set("1", []byte("root"))
+	users.Set("1", []byte("alice"))
+	orders.Set("1", []byte("order"))
+	users.Set("2", []byte("bob"))
+	for _, c := range []struct {
+		get   func(string) ([]byte, bool, error)
+		value string
+	}{{kh.Get, "root"}, {users.Get, "alice"}, {orders.Get, "order"}} {
+		if data, found, err := c.get("1"); err != nil || !found || string(data) != c.value {
+			t.Fatalf("Incorrect data: %s %v %v", data, found, err)
+		}
+	}
+	if keys, _ := kh.Keys(); len(keys) != 1 {
+		t.Fatalf("Bucket keys were included in the KeyHandler's: %v", keys)
+	}
+	if names, _ := kh.Buckets(); strings.Join(names, ",") != "orders,users" {
+		t.Fatalf("Incorrect buckets: %v", names)
+	}
+
+	if err = kh.RenameBucket("users", "orders"); err != ErrBucketExists {
+		t.Fatalf("Expected ErrBucketExists: %v", err)
+	}
+	if err = kh.RenameBucket("users", "people"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	//the handle follows the rename
+	if data, _, _ := users.Get("2"); string(data) != "bob" {
+		t.Fatalf("Incorrect data after rename: %s", data)
+	}
+	if _, err = kh.Bucket("users"); err != ErrBucketNotFound {
+		t.Fatalf("Expected ErrBucketNotFound after rename: %v", err)
+	}
+
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	people, err := kh.Bucket("people")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if keys, _ := people.Keys(); strings.Join(keys, ",") != "1,2" {
+		t.Fatalf("Incorrect keys after reopening: %v", keys)
+	}
+	if names, _ := kh.Buckets(); strings.Join(names, ",") != "orders,people" {
+		t.Fatalf("Incorrect buckets after reopening: %v", names)
+	}
+
+	if err = kh.DropBucket("people"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, _, err = people.Get("1"); err != ErrBucketNotFound {
+		t.Fatalf("Expected ErrBucketNotFound from a dropped bucket: %v", err)
+	}
+	if err = people.Set("1", nil); err != ErrBucketNotFound {
+		t.Fatalf("Expected ErrBucketNotFound from a dropped bucket: %v", err)
+	}
+	if err = kh.DropBucket("people"); err != ErrBucketNotFound {
+		t.Fatalf("Expected ErrBucketNotFound: %v", err)
+	}
+
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if names, _ := kh.Buckets(); strings.Join(names, ",") != "orders" {
+		t.Fatalf("Incorrect buckets after dropping: %v", names)
+	}
+	if data, _, _ := kh.Get("1"); string(data) != "root" {
+		t.Fatalf("Incorrect data after dropping: %s", data)
+	}
+}
+
+func TestNestedBuckets(t *testing.T) {
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.CreateBucket("tenants", "acme"); err != ErrBucketNotFound {
+		t.Fatalf("Expected ErrBucketNotFound without the parent: %v", err)
+	}
+	tenants, err := kh.CreateBucket("tenants")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	acme, err := tenants.CreateBucket("acme")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	sessions, err := kh.CreateBucket("tenants", "acme", "sessions")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.CreateBucket("tenants", "other"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.CreateBucket("tenants", "other", "sessions"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	acme.Set("name", []byte("Acme"))
+	sessions.Set("s1", []byte("session"))
+
+	//the same name in different places is a different bucket
+	if _, err = kh.CreateBucket("acme"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if names, _ := tenants.Buckets(); strings.Join(names, ",") != "acme,other" {
+		t.Fatalf("Incorrect buckets: %v", names)
+	}
+	if err = tenants.RenameBucket("acme", "acme2"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	b, err := kh.Bucket("tenants", "acme2", "sessions")
+	if err != nil {
+		t.Fatalf("Error finding a bucket in a renamed one: %v", err)
+	}
+	if data, _, _ := b.Get("s1"); string(data) != "session" {
+		t.Fatalf("Incorrect data after reopening: %s", data)
+	}
+	if names, _ := kh.Buckets(); strings.Join(names, ",") != "acme,tenants" {
+		t.Fatalf("Incorrect buckets after reopening: %v", names)
+	}
+
+	if err = kh.DropBucket("tenants", "acme2"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, _, err = b.Get("s1"); err != ErrBucketNotFound {
+		t.Fatalf("Expected ErrBucketNotFound in a dropped subtree: %v", err)
+	}
+	if _, err = kh.Bucket("tenants", "other", "sessions"); err != nil {
+		t.Fatalf("Dropping a bucket dropped its sibling: %v", err)
+	}
+
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if names, _ := kh.Buckets(); strings.Join(names, ",") != "acme,tenants" {
+		t.Fatalf("Incorrect buckets after dropping: %v", names)
+	}
+	tenants, _ = kh.Bucket("tenants")
+	if names, _ := tenants.Buckets(); strings.Join(names, ",") != "other" {
+		t.Fatalf("Incorrect buckets after dropping: %v", names)
+	}
+	if dir := kh.dir; len(dir.datalocs) != 4 {
+		t.Fatalf("Incorrect number of directory entries: %d", len(dir.datalocs))
+	}
+}
+
+func TestDropBucketFrees(t *testing.T) {
+	//Dropping a bucket lets a new one reuse its space
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fill := func() {
+		b, err := kh.CreateBucket("b")
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		for i := 0; i < 600; i++ {
+			if err = b.Set(fmt.Sprint(i), []byte(strings.Repeat("x", 100))); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+		}
+	}
+	empty := len(ms.data)
+	fill()
+	if err = kh.DropBucket("b"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	//freed blocks get split, so it can still grow some
+	size := len(ms.data)
+	fill()
+	if len(ms.data)-size > (size-empty)/4 {
+		t.Fatalf("File grew from %d to %d after dropping", size, len(ms.data))
+	}
+}
+
+func TestForEach(t *testing.T) {
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, &Options{CacheSize: 1024})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, key := range []string{"c", "a", "b"} {
+		kh.Set(key, []byte(key+key))
+	}
+	var seen []string
+	err = kh.ForEach(func(key string, data []byte) error {
+		if string(data) != key+key {
+			t.Fatalf("Incorrect data for %s: %s", key, data)
+		}
+		seen = append(seen, key)
+		return nil
+	})
+	if err != nil || strings.Join(seen, ",") != "a,b,c" {
+		t.Fatalf("Incorrect keys: %v %v", seen, err)
+	}
+
+	stop := errors.New("stop")
+	seen = nil
+	err = kh.ForEach(func(key string, data []byte) error {
+		seen = append(seen, key)
+		return stop
+	})
+	if err != stop || len(seen) != 1 {
+		t.Fatalf("ForEach didn't stop: %v %v", seen, err)
+	}
+}
+
+func TestCrashBuckets(t *testing.T) {
+	//Fails each write of the bucket operations and checks that the
+	//buckets are either before or after the operation when reopened
+	setup := func() []byte {
+		ms := NewMemStorage()
+		kh, err := OpenStorage(ms, nil)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		b, err := kh.CreateBucket("old")
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		b.Set("key", []byte("value"))
+		child, err := b.CreateBucket("child")
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		child.Set("key", []byte("child"))
+		kh.Set("key", []byte("root"))
+		return append([]byte{}, ms.data...)
+	}
+	data := setup()
+
+	ops := []struct {
+		name string
+		run  func(kh *KeyHandler) error
+		//the buckets that can be there afterwards, before and after
+		states []string
+	}{
+		{"create", func(kh *KeyHandler) error {
+			_, err := kh.CreateBucket("new")
+			return err
+		}, []string{"old", "new,old"}},
+		{"rename", func(kh *KeyHandler) error {
+			return kh.RenameBucket("old", "renamed")
+		}, []string{"old", "renamed"}},
+		{"drop", func(kh *KeyHandler) error {
+			return kh.DropBucket("old")
+		}, []string{"old", ""}},
+	}
+	for _, op := range ops {
+		fs := newFaultStorage(data)
+		kh, err := OpenStorage(fs, nil)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		fs.writes = 0
+		if err = op.run(kh); err != nil {
+			t.Fatalf("%s: Error without failures: %v", op.name, err)
+		}
+		total := fs.writes
+
+		for _, n := range crashPoints(total) {
+			fs := newFaultStorage(data)
+			kh, err := OpenStorage(fs, nil)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			fs.writes = 0
+			fs.failAt = n
+			fs.tear = 1
+			if err = op.run(kh); !errors.Is(err, errInjected) {
+				t.Fatalf("%s: Expected the failed write %d to be returned: %v", op.name, n, err)
+			}
+
+			for _, keep := range []int{len(fs.pending), 0} {
+				kh, err := OpenStorage(fs.crash(keep), nil)
+				if err != nil {
+					t.Fatalf("%s: failing write %d: Error reopening: %v", op.name, n, err)
+				}
+				names, _ := kh.Buckets()
+				got := strings.Join(names, ",")
+				if got != op.states[0] && got != op.states[1] {
+					t.Fatalf("%s: failing write %d, keeping %d: Incorrect buckets: %q", op.name, n, keep, got)
+				}
+				for _, name := range names {
+					b, _ := kh.Bucket(name)
+					data, _, err := b.Get("key")
+					if name != "new" && string(data) != "value" {
+						t.Fatalf("%s: failing write %d: Incorrect data in %s: %q %v", op.name, n, name, data, err)
+					}
+					if name == "new" {
+						continue
+					}
+					//a failed drop can take out the child and leave the parent
+					child, err := b.Bucket("child")
+					if err == ErrBucketNotFound && op.name == "drop" {
+						continue
+					}
+					if err != nil {
+						t.Fatalf("%s: failing write %d: Error: %v", op.name, n, err)
+					}
+					if data, _, _ := child.Get("key"); string(data) != "child" {
+						t.Fatalf("%s: failing write %d: Incorrect data in child: %q", op.name, n, data)
+					}
+				}
+				if data, _, _ := kh.Get("key"); string(data) != "root" {
+					t.Fatalf("%s: failing write %d: Incorrect data: %q", op.name, n, data)
+				}
+				if _, err = kh.CreateBucket("after"); err != nil {
+					t.Fatalf("%s: failing write %d: Error writing after: %v", op.name, n, err)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package gokvlite
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+//Counters for the value cache, see Options.CacheSize
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Size    int64
+}
+
+type cacheEntry struct {
+	key  string
+	data []byte
+}
+
+type valueCache struct {
+	//This is an LRU of values limited by the total size of the values.
+	//It has its own lock since readers update it while sharing the
+	//KeyHandler read lock
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	lru     list.List
+	entries map[string]*list.Element
+	hits    uint64
+	misses  uint64
+}
+
+func newValueCache(maxSize int64) *valueCache {
+	vc := new(valueCache)
+	vc.maxSize = maxSize
+	vc.entries = make(map[string]*list.Element)
+	return vc
+}
+
+func (vc *valueCache) get(key string) ([]byte, bool) {
+	//Returns the cached value and moves it to the front. The value
+	//must not be modified
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	el, ok := vc.entries[key]
+	if !ok {
+		vc.misses++
+		return nil, false
+	}
+	vc.hits++
+	vc.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry).data, true
+}
+
+func (vc *valueCache) add(key string, data []byte) {
+	//Caches data for key, evicting the least recently used values to
+	//stay under the size budget. data must not be modified afterwards
+	size := int64(len(data))
+	if size > vc.maxSize {
+		return
+	}
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if el, ok := vc.entries[key]; ok {
+		vc.removeElement(el)
+	}
+	for vc.size+size > vc.maxSize {
+		vc.removeElement(vc.lru.Back())
+	}
+	vc.entries[key] = vc.lru.PushFront(&cacheEntry{key, data})
+	vc.size += size
+}
+
+func (vc *valueCache) remove(key string) {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if el, ok := vc.entries[key]; ok {
+		vc.removeElement(el)
+	}
+}
+
+func (vc *valueCache) removePrefix(prefix string) {
+	//Removes every value with a key starting with prefix
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	for key, el := range vc.entries {
+		if strings.HasPrefix(key, prefix) {
+			vc.removeElement(el)
+		}
+	}
+}
+
+func (vc *valueCache) removeElement(el *list.Element) {
+	entry := vc.lru.Remove(el).(*cacheEntry)
+	delete(vc.entries, entry.key)
+	vc.size -= int64(len(entry.data))
+}
+
+func (vc *valueCache) stats() CacheStats {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	return CacheStats{vc.hits, vc.misses, vc.lru.Len(), vc.size}
+}
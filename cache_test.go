@@ -0,0 +1,121 @@
+package gokvlite
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestValueCache(t *testing.T) {
+	vc := newValueCache(10)
+	vc.add("a", []byte("12345"))
+	vc.add("b", []byte("1234"))
+	if _, ok := vc.get("a"); !ok {
+		t.Fatalf("a wasn't cached")
+	}
+
+	//b is now the least recently used and is evicted first
+	vc.add("c", []byte("123"))
+	if _, ok := vc.get("b"); ok {
+		t.Fatalf("b wasn't evicted")
+	}
+	if data, ok := vc.get("c"); !ok || string(data) != "123" {
+		t.Fatalf("Incorrect data for c")
+	}
+
+	//Values larger than the budget aren't cached
+	vc.add("d", []byte("12345678901"))
+	if _, ok := vc.get("d"); ok {
+		t.Fatalf("Value larger than the cache was cached")
+	}
+
+	vc.remove("a")
+	stats := vc.stats()
+	if stats.Entries != 1 || stats.Size != 3 {
+		t.Fatalf("Incorrect stats after remove: %+v", stats)
+	}
+	if stats.Hits != 2 || stats.Misses != 2 {
+		t.Fatalf("Incorrect counters: %+v", stats)
+	}
+}
+
+func TestCache(t *testing.T) {
+	tempfile := "/tmp/gotest_cache"
+	os.Remove(tempfile)
+	kh, err := OpenWithOptions(tempfile, &Options{CacheSize: 1024})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer kh.Close()
+
+	//values small enough to be inline aren't cached
+	value := strings.Repeat("blah", inlineSize)
+	if err = kh.Set("Testing", []byte(value)); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		data, _, err := kh.Get("Testing")
+		if err != nil || string(data) != value {
+			t.Fatalf("Incorrect data: %s %v", data, err)
+		}
+		//Changing the returned value doesn't change the cache
+		data[0] = 'x'
+	}
+	stats := kh.CacheStats()
+	if stats.Hits != 2 || stats.Misses != 1 {
+		t.Fatalf("Incorrect counters: %+v", stats)
+	}
+
+	//Set and Del invalidate
+	if err = kh.Set("Testing", []byte("halb")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if data, _, _ := kh.Get("Testing"); string(data) != "halb" {
+		t.Fatalf("Stale data after Set: %s", data)
+	}
+	if _, err = kh.Del("Testing"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, found, _ := kh.Get("Testing"); found {
+		t.Fatalf("Key found in the cache after Del")
+	}
+}
+
+func TestCacheConcurrentReaders(t *testing.T) {
+	tempfile := "/tmp/gotest_cache_concurrent"
+	os.Remove(tempfile)
+	kh, err := OpenWithOptions(tempfile, &Options{CacheSize: 64})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer kh.Close()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err = kh.Set(key, []byte(key)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("key%d", (i+g)%20)
+				if i%50 == 0 {
+					kh.Set(key, []byte(key))
+				}
+				data, _, err := kh.Get(key)
+				if err != nil || string(data) != key {
+					t.Errorf("Incorrect data for %s: %s %v", key, data, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
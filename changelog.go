@@ -0,0 +1,367 @@
+package gokvlite
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+//The change log is a bucket in the bucket directory under this id, like
+//the index buckets. Its keys are the seqs of the changes, big endian so
+//that they're in order, and its values are the Op followed by the key
+//that was written. The empty key holds the seq the log starts after.
+//The position of a follower, and of the backups restored onto the
+//database, are kept under the same id, see storedSeq
+const changeLogParent int64 = -2
+
+const changeLogName = "changes"
+
+//How many changes a ChangeIterator takes from the log at a time
+const changeBatch = 256
+
+//How many bytes the change log can take by default, see
+//Options.ChangeLogSize
+const defaultChangeLogSize = 64 << 20
+
+type changeLog struct {
+	ks *keySpace
+	//the changes in the log, oldest first
+	changes []Event
+	//the seq the log starts after. Every change since then is in it
+	start int64
+	//the footprint of the changes in changes
+	size     int64
+	maxCount int
+	maxSize  int64
+}
+
+func changeKey(seq int64) string {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(seq))
+	return string(key)
+}
+
+func (kh *KeyHandler) storedSeq(name string) (seq int64, written int64, err error) {
+	//Returns the seq kept in the empty key of the bucket called name
+	//under changeLogParent, and the seq of the last write that kept it,
+	//which is the one to the directory if the bucket was just made, or
+	//-1 for both if there's none
+	ks := kh.changeRoot.children[name]
+	if ks == nil {
+		return -1, -1, nil
+	}
+	info := ks.datalocs[""]
+	data, _, err := ks.get("")
+	if err != nil {
+		return 0, 0, err
+	}
+	if info == nil || len(data) != 8 {
+		return 0, 0, fmt.Errorf("changelog: storedSeq: Invalid seq %q in %s: %w", data, name, ErrCorrupt)
+	}
+	written = info.Seq
+	if dir := kh.dir.datalocs[dirKey(changeLogParent, name)]; dir != nil && dir.Seq > written {
+		written = dir.Seq
+	}
+	return int64(binary.BigEndian.Uint64(data)), written, nil
+}
+
+func (kh *KeyHandler) setStoredSeq(name string, seq int64) error {
+	data := []byte(changeKey(seq))
+	if ks := kh.changeRoot.children[name]; ks != nil {
+		return ks.set("", data)
+	}
+	//the seq is in the bucket before the directory points at it
+	ks := kh.newKeySpace(nil)
+	if err := ks.makeNewList(); err != nil {
+		return err
+	}
+	if err := ks.set("", data); err != nil {
+		return err
+	}
+	if err := kh.writeBucket(changeLogParent, name, ks); err != nil {
+		return err
+	}
+	ks.name = name
+	ks.parent = kh.changeRoot
+	kh.changeRoot.children[name] = ks
+	return nil
+}
+
+func (cl *changeLog) put(key string, seq int64, value []byte) error {
+	//Writes an entry of the log. Entries get the seq of the change they
+	//are for rather than a new one, so the log doesn't use up seqs
+	ks := cl.ks
+	size, flags, fill := ks.kh.dataWriter(key, value, ks.encryptFlags())
+	old := ks.datalocs[key]
+	info, err := ks.writeVersion(key, old, seq, size, flags, false, fill)
+	if err != nil {
+		return err
+	}
+	ks.datalocs[key] = info
+	if old == nil {
+		return nil
+	}
+	return ks.release(old, info)
+}
+
+func (cl *changeLog) remove(seq int64) error {
+	key := changeKey(seq)
+	info, ok := cl.ks.datalocs[key]
+	if !ok {
+		return nil
+	}
+	delete(cl.ks.datalocs, key)
+	return cl.ks.release(info, nil)
+}
+
+func footprint(key string) int64 {
+	//Returns about how many bytes a change to key takes, which is its
+	//entry, its blocks and their entries in the file, and the key kept
+	//in memory. It's the same whether the entry is inline or encrypted,
+	//so it doesn't change with Rekey
+	entries := binary.Size(keyEntry{}) + 2*binary.Size(blockListArrayEntryData{})
+	return int64(entries) + 8 + 1 + 2*int64(len(key))
+}
+
+func (cl *changeLog) add(event Event) error {
+	value := append([]byte{byte(event.Op)}, event.Key...)
+	if err := cl.put(changeKey(event.Seq), event.Seq, value); err != nil {
+		return err
+	}
+	cl.changes = append(cl.changes, event)
+	cl.size += footprint(event.Key)
+	return cl.trim()
+}
+
+func (cl *changeLog) trim() error {
+	//Drops the oldest changes past the limits. The start of the log is
+	//moved past them before they're removed, so whatever's left of them
+	//after a failure is dropped when the log is read
+	n := 0
+	size := cl.size
+	for n < len(cl.changes) && (cl.maxCount > 0 && len(cl.changes)-n > cl.maxCount || cl.maxSize > 0 && size > cl.maxSize) {
+		size -= footprint(cl.changes[n].Key)
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+	dropped := cl.changes[:n]
+	start := dropped[n-1].Seq
+	if err := cl.put("", cl.ks.kh.seq, []byte(changeKey(start))); err != nil {
+		return err
+	}
+	cl.start = start
+	cl.changes = cl.changes[n:]
+	cl.size = size
+	for _, event := range dropped {
+		if err := cl.remove(event.Seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cl *changeLog) unlog(seq int64) {
+	//Takes the last change back out after its write failed. If that
+	//fails too, it's dropped when the log is read, since the write it's
+	//for isn't in the file
+	last := len(cl.changes) - 1
+	if last < 0 || cl.changes[last].Seq != seq {
+		return
+	}
+	cl.size -= footprint(cl.changes[last].Key)
+	cl.changes = cl.changes[:last]
+	cl.remove(seq)
+}
+
+func (kh *KeyHandler) logChange(ks *keySpace, key string, op Op, seq int64) error {
+	//Adds the write numbered seq to the change log before it's made
+	if ks != &kh.keySpace || kh.changes == nil {
+		return nil
+	}
+	return kh.changes.add(Event{key, op, seq})
+}
+
+func (kh *KeyHandler) unlogChange(ks *keySpace, seq int64) {
+	if ks != &kh.keySpace || kh.changes == nil {
+		return
+	}
+	kh.changes.unlog(seq)
+}
+
+func (kh *KeyHandler) written(event Event) bool {
+	//Returns if the write of event made it to the file
+	info := kh.datalocs[event.Key]
+	if event.Op == OpSet {
+		return info != nil && info.Seq == event.Seq
+	}
+	return info == nil || info.Seq > event.Seq
+}
+
+func (kh *KeyHandler) readChangeLog(opts *Options) error {
+	//Reads the change log into kh.changes, making one with
+	//Options.ChangeLog if there's none. A log that's there is kept up to
+	//date without the option too, since the writes made without it
+	//would be missing. Changes are logged before they're written, so the
+	//last one is dropped if its write didn't make it
+	ks := kh.changeRoot.children[changeLogName]
+	if ks == nil && (!opts.ChangeLog || kh.readOnly) {
+		return nil
+	}
+	cl := &changeLog{ks: ks, start: kh.seq, maxCount: opts.ChangeLogCount, maxSize: opts.ChangeLogSize}
+	if cl.maxSize == 0 {
+		cl.maxSize = defaultChangeLogSize
+	}
+	if ks == nil {
+		cl.ks = kh.newKeySpace(nil)
+		if err := cl.ks.makeNewList(); err != nil {
+			return err
+		}
+		if err := cl.put("", kh.seq, []byte(changeKey(cl.start))); err != nil {
+			return err
+		}
+		if err := kh.writeBucket(changeLogParent, changeLogName, cl.ks); err != nil {
+			return err
+		}
+		cl.ks.name = changeLogName
+		cl.ks.parent = kh.changeRoot
+		kh.changeRoot.children[changeLogName] = cl.ks
+		kh.changes = cl
+		return nil
+	}
+
+	data, _, err := ks.get("")
+	if err != nil {
+		return err
+	}
+	if len(data) != 8 {
+		return fmt.Errorf("changelog: readChangeLog: Invalid start %q: %w", data, ErrCorrupt)
+	}
+	cl.start = int64(binary.BigEndian.Uint64(data))
+	keys, _ := ks.keys()
+	var stale []int64
+	for _, key := range keys[1:] {
+		data, _, err = ks.get(key)
+		if err != nil {
+			return err
+		}
+		if len(key) != 8 || len(data) == 0 {
+			return fmt.Errorf("changelog: readChangeLog: Invalid change %q: %w", key, ErrCorrupt)
+		}
+		seq := int64(binary.BigEndian.Uint64([]byte(key)))
+		if seq <= cl.start {
+			//left by a trim that didn't finish
+			stale = append(stale, seq)
+			continue
+		}
+		cl.changes = append(cl.changes, Event{string(data[1:]), Op(data[0]), seq})
+		cl.size += footprint(string(data[1:]))
+	}
+	if last := len(cl.changes) - 1; last >= 0 && !kh.written(cl.changes[last]) {
+		stale = append(stale, cl.changes[last].Seq)
+		cl.size -= footprint(cl.changes[last].Key)
+		cl.changes = cl.changes[:last]
+	}
+	kh.changes = cl
+	if kh.readOnly {
+		return nil
+	}
+	for _, seq := range stale {
+		if err = cl.remove(seq); err != nil {
+			return err
+		}
+	}
+	//the limits can change between opens
+	return cl.trim()
+}
+
+//A ChangeIterator goes through the change log in order, see ChangesSince
+type ChangeIterator struct {
+	kh *KeyHandler
+	//the seq of the last change returned
+	seq   int64
+	batch []Event
+	event Event
+	err   error
+}
+
+//Returns a ChangeIterator over the writes to the keys of kh numbered
+//after seq, as kept with Options.ChangeLog. A consumer that keeps the
+//seq of the last change it handled can pick up from there after a
+//restart. Returns ErrChangeLogOff without the log, or ErrChangesTrimmed
+//if changes after seq were already dropped from it
+func (kh *KeyHandler) ChangesSince(seq int64) (*ChangeIterator, error) {
+	if _, err := kh.changesAfter(seq, 0); err != nil {
+		return nil, err
+	}
+	return &ChangeIterator{kh: kh, seq: seq}, nil
+}
+
+//Deletes the change log from the file, so the writes from now on aren't
+//logged until the file is opened with Options.ChangeLog again. Returns
+//ErrChangeLogOff if there's no log
+func (kh *KeyHandler) DropChangeLog() error {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if err := kh.checkWrite(""); err != nil {
+		return err
+	}
+	if kh.changes == nil {
+		return ErrChangeLogOff
+	}
+	kh.changes = nil
+	return kh.changeRoot.dropBucket(changeLogName)
+}
+
+func (kh *KeyHandler) changesAfter(seq int64, max int) ([]Event, error) {
+	//Returns up to max changes after seq
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	switch {
+	case kh.closed:
+		return nil, ErrClosed
+	case kh.changes == nil:
+		return nil, ErrChangeLogOff
+	case seq < kh.changes.start:
+		return nil, ErrChangesTrimmed
+	}
+	changes := kh.changes.changes
+	i := sort.Search(len(changes), func(i int) bool {
+		return changes[i].Seq > seq
+	})
+	changes = changes[i:min(len(changes), i+max)]
+	return append([]Event(nil), changes...), nil
+}
+
+//Moves to the next change and returns true, or returns false at the
+//end of the log or on an error. Changes made since the iterator was
+//made are included, so Next can be called again later for the changes
+//made after the end was reached
+func (it *ChangeIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if len(it.batch) == 0 {
+		it.batch, it.err = it.kh.changesAfter(it.seq, changeBatch)
+		if len(it.batch) == 0 {
+			return false
+		}
+	}
+	it.event = it.batch[0]
+	it.batch = it.batch[1:]
+	it.seq = it.event.Seq
+	return true
+}
+
+//Returns the change Next moved to
+func (it *ChangeIterator) Event() Event {
+	return it.event
+}
+
+//Returns the error that stopped Next, if any. It's ErrChangesTrimmed
+//if the changes after the last one returned were dropped from the log
+//before Next got to them
+func (it *ChangeIterator) Err() error {
+	return it.err
+}
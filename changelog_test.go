@@ -0,0 +1,168 @@
+package gokvlite
+
+import (
+	"fmt"
+	"testing"
+)
+
+func readChanges(t *testing.T, it *ChangeIterator) []Event {
+	var events []Event
+	for it.Next() {
+		events = append(events, it.Event())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return events
+}
+
+func checkChanges(t *testing.T, kh *KeyHandler, since int64, want []Event) {
+	it, err := kh.ChangesSince(since)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if events := readChanges(t, it); fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Fatalf("Incorrect changes since %d: %v, expected %v", since, events, want)
+	}
+}
+
+func TestChangeLog(t *testing.T) {
+	ms := NewMemStorage()
+	opts := &Options{ChangeLog: true}
+	kh, err := OpenStorage(ms, opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var want []Event
+	for _, key := range []string{"a", "b"} {
+		if err = kh.Set(key, []byte("value")); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		want = append(want, Event{key, OpSet, kh.Seq()})
+	}
+	if _, err = kh.Del("a"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	want = append(want, Event{"a", OpDel, kh.Seq()})
+	if _, err = kh.Del("missing"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	b, err := kh.CreateBucket("bucket")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = b.Set("c", []byte("value")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkChanges(t, kh, 0, want)
+
+	//a change that was logged, but whose write didn't make it
+	if err = kh.changes.add(Event{"b", OpDel, kh.nextSeq()}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	kh, err = OpenStorage(ms, opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkChanges(t, kh, want[0].Seq, want[1:])
+
+	//an iterator at the end picks up later changes
+	it, err := kh.ChangesSince(want[2].Seq)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if events := readChanges(t, it); len(events) != 0 {
+		t.Fatalf("Unexpected changes: %v", events)
+	}
+	if err = kh.Set("d", []byte("value")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if events := readChanges(t, it); len(events) != 1 || events[0] != (Event{"d", OpSet, kh.Seq()}) {
+		t.Fatalf("Incorrect later changes: %v", events)
+	}
+
+	//opening without the option keeps the log up to date, and it's only
+	//dropped when asked for
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("e", []byte("value")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	want = append(want, Event{"d", OpSet, kh.Seq() - 1}, Event{"e", OpSet, kh.Seq()})
+	checkChanges(t, kh, want[0].Seq, want[1:])
+	if err = kh.DropChangeLog(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.ChangesSince(0); err != ErrChangeLogOff {
+		t.Fatalf("Incorrect error without the log: %v", err)
+	}
+	if err = kh.DropChangeLog(); err != ErrChangeLogOff {
+		t.Fatalf("Incorrect error dropping the log again: %v", err)
+	}
+	if err = kh.Set("f", []byte("value")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.ChangesSince(0); err != ErrChangeLogOff {
+		t.Fatalf("Incorrect error after dropping the log: %v", err)
+	}
+	kh, err = OpenStorage(ms, opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.ChangesSince(0); err != ErrChangesTrimmed {
+		t.Fatalf("Incorrect error for changes before the log: %v", err)
+	}
+	checkChanges(t, kh, kh.Seq(), nil)
+}
+
+func TestChangeLogRetention(t *testing.T) {
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, &Options{ChangeLog: true, ChangeLogCount: 3})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	it, err := kh.ChangesSince(0)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var want []Event
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprint("key-", i)
+		if err = kh.Set(key, []byte("value")); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		want = append(want, Event{key, OpSet, kh.Seq()})
+	}
+	if it.Next() || it.Err() != ErrChangesTrimmed {
+		t.Fatalf("Incorrect error for trimmed changes: %v", it.Err())
+	}
+	checkChanges(t, kh, want[1].Seq, want[2:])
+
+	//each key is 5 bytes, so 2 changes fit in the size
+	kh, err = OpenStorage(ms, &Options{ChangeLog: true, ChangeLogSize: 2*footprint("key-0") + 1})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkChanges(t, kh, want[2].Seq, want[3:])
+	if len(kh.changes.ks.datalocs) != 3 {
+		t.Fatalf("Trimmed changes left in the log: %d entries", len(kh.changes.ks.datalocs))
+	}
+
+	//the size is limited unless it's -1
+	for size, limit := range map[int64]int64{0: defaultChangeLogSize, -1: -1} {
+		kh, err = OpenStorage(ms, &Options{ChangeLog: true, ChangeLogSize: size})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if kh.changes.maxSize != limit {
+			t.Fatalf("Size limit for %d is %d, expected %d", size, kh.changes.maxSize, limit)
+		}
+		checkChanges(t, kh, want[2].Seq, want[3:])
+	}
+}
@@ -0,0 +1,295 @@
+//Command gokvlite works with gokvlite databases from the command line.
+//
+//Usage:
+//
+//	gokvlite backup [options] [-since seq] <database> <backup file>
+//	gokvlite restore [options] <backup file> <incremental backup>...
+//	gokvlite reshard [options] <store> <shards> <new shards>
+//	gokvlite export [options] [-format csv|jsonl] [-encoding utf8|base64|json] <database> <file>
+//	gokvlite import [options] [-format csv|jsonl] [-encoding utf8|base64|json] <database> <file>
+//	gokvlite upgrade [options] <database>
+//
+//Options:
+//
+//	-keep-versions n  keep up to n earlier versions of each key, -1 for all
+//	-changelog        start a change log if the database has none
+//
+//The backup command writes a consistent copy of the database, or an
+//incremental backup of what changed since seq, and prints the seq to take
+//the next incremental backup since. The restore command applies
+//incremental backups in order onto a full backup. The reshard command
+//moves the keys of a ShardedStore to a new number of shards. The export
+//and import commands write the keys of the database to a CSV or JSON
+//Lines file and read them back, with - for standard output or input. The
+//encoding is how values are written, utf8 by default, which in CSV reads
+//a \r\n in a value back as \n. The upgrade command rewrites a database
+//from before the file format had a version in the current one. The
+//database must not be open in another process while a command runs. An
+//encrypted database is opened with the key in GOKVLITE_KEY, hex encoded.
+//The options set Options.KeepVersions and Options.ChangeLog for opening
+//the database. A change log the database has is kept up to date either
+//way
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/finder/gokvlite"
+)
+
+var errUsage = errors.New("usage")
+
+var commands = map[string]func(args []string) error{
+	"backup":  backup,
+	"restore": restore,
+	"reshard": reshard,
+	"export":  export,
+	"import":  importKeys,
+	"upgrade": upgrade,
+}
+
+func main() {
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		usage()
+	}
+	err := commands[os.Args[1]](os.Args[2:])
+	if err == errUsage {
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gokvlite %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+	gokvlite backup [options] [-since seq] <database> <backup file>
+	gokvlite restore [options] <backup file> <incremental backup>...
+	gokvlite reshard [options] <store> <shards> <new shards>
+	gokvlite export [options] [-format csv|jsonl] [-encoding utf8|base64|json] <database> <file>
+	gokvlite import [options] [-format csv|jsonl] [-encoding utf8|base64|json] <database> <file>
+	gokvlite upgrade [options] <database>
+options:
+	-keep-versions n  keep up to n earlier versions of each key, -1 for all
+	-changelog        start a change log if the database has none`)
+	os.Exit(2)
+}
+
+//The options every command takes, for opening the database
+type optionFlags struct {
+	keepVersions *int
+	changeLog    *bool
+}
+
+func newFlags(name string) (*flag.FlagSet, *optionFlags) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	return flags, &optionFlags{
+		flags.Int("keep-versions", 0, "keep up to this many earlier versions of each key, -1 for all"),
+		flags.Bool("changelog", false, "start a change log if the database has none"),
+	}
+}
+
+func (of *optionFlags) options(readOnly bool) (*gokvlite.Options, error) {
+	opts := &gokvlite.Options{
+		ReadOnly:     readOnly,
+		KeepVersions: *of.keepVersions,
+		ChangeLog:    *of.changeLog,
+	}
+	if key := os.Getenv("GOKVLITE_KEY"); key != "" {
+		var err error
+		opts.EncryptionKey, err = hex.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("GOKVLITE_KEY: %v", err)
+		}
+	}
+	return opts, nil
+}
+
+func (of *optionFlags) open(path string, readOnly bool) (*gokvlite.KeyHandler, error) {
+	opts, err := of.options(readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return gokvlite.OpenWithOptions(path, opts)
+}
+
+func backup(args []string) error {
+	flags, of := newFlags("backup")
+	since := flags.Int64("since", -1, "take an incremental backup of the writes after this seq")
+	if flags.Parse(args) != nil || flags.NArg() != 2 {
+		return errUsage
+	}
+	kh, err := of.open(flags.Arg(0), true)
+	if err != nil {
+		return err
+	}
+	defer kh.Close()
+	if *since < 0 {
+		seq, err := kh.BackupTo(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		fmt.Println(seq)
+		return nil
+	}
+
+	file, err := os.Create(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	seq, err := kh.BackupSince(file, *since)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(seq)
+	return nil
+}
+
+func restore(args []string) error {
+	flags, of := newFlags("restore")
+	if flags.Parse(args) != nil || flags.NArg() < 2 {
+		return errUsage
+	}
+	args = flags.Args()
+	opts, err := of.options(false)
+	if err != nil {
+		return err
+	}
+	var incrementals []io.Reader
+	for _, path := range args[1:] {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		incrementals = append(incrementals, file)
+	}
+	return gokvlite.RestoreBackup(args[0], opts, incrementals...)
+}
+
+func reshard(args []string) error {
+	flags, of := newFlags("reshard")
+	if flags.Parse(args) != nil || flags.NArg() != 3 {
+		return errUsage
+	}
+	args = flags.Args()
+	from, err := strconv.Atoi(args[1])
+	if err != nil {
+		return errUsage
+	}
+	to, err := strconv.Atoi(args[2])
+	if err != nil {
+		return errUsage
+	}
+	opts, err := of.options(false)
+	if err != nil {
+		return err
+	}
+	return gokvlite.Reshard(args[0], from, to, opts)
+}
+
+var encodings = map[string]gokvlite.ValueEncoding{
+	"utf8":   gokvlite.EncodingUTF8,
+	"base64": gokvlite.EncodingBase64,
+	"json":   gokvlite.EncodingJSON,
+}
+
+func transferFlags(name string, args []string) (of *optionFlags, format string, enc gokvlite.ValueEncoding, rest []string, err error) {
+	//Parses the flags export and import have in common
+	flags, of := newFlags(name)
+	formatFlag := flags.String("format", "csv", "csv or jsonl")
+	encFlag := flags.String("encoding", "utf8", "how values are written: utf8, base64 or json")
+	if flags.Parse(args) != nil || flags.NArg() != 2 {
+		return nil, "", 0, nil, errUsage
+	}
+	enc, ok := encodings[*encFlag]
+	if !ok || *formatFlag != "csv" && *formatFlag != "jsonl" {
+		return nil, "", 0, nil, errUsage
+	}
+	return of, *formatFlag, enc, flags.Args(), nil
+}
+
+func export(args []string) error {
+	of, format, enc, args, err := transferFlags("export", args)
+	if err != nil {
+		return err
+	}
+	kh, err := of.open(args[0], true)
+	if err != nil {
+		return err
+	}
+	defer kh.Close()
+	file := os.Stdout
+	if args[1] != "-" {
+		if file, err = os.Create(args[1]); err != nil {
+			return err
+		}
+	}
+	if format == "csv" {
+		err = gokvlite.ExportCSV(kh, file, enc)
+	} else {
+		err = gokvlite.ExportJSONL(kh, file, enc)
+	}
+	if file == os.Stdout {
+		return err
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func importKeys(args []string) error {
+	of, format, enc, args, err := transferFlags("import", args)
+	if err != nil {
+		return err
+	}
+	file := os.Stdin
+	if args[1] != "-" {
+		if file, err = os.Open(args[1]); err != nil {
+			return err
+		}
+		defer file.Close()
+	}
+	kh, err := of.open(args[0], false)
+	if err != nil {
+		return err
+	}
+	if format == "csv" {
+		err = gokvlite.ImportCSV(kh, file, enc)
+	} else {
+		err = gokvlite.ImportJSONL(kh, file, enc)
+	}
+	if closeErr := kh.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func upgrade(args []string) error {
+	flags, of := newFlags("upgrade")
+	if flags.Parse(args) != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+	opts, err := of.options(false)
+	if err != nil {
+		return err
+	}
+	return gokvlite.Upgrade(flags.Arg(0), opts)
+}
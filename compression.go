@@ -0,0 +1,106 @@
+package gokvlite
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+//Compresses values before they're written, see Options.Compressor.
+//Every compressed value starts with the ID of the compressor that wrote
+//it, so it has to be registered with RegisterCompressor for the value to
+//be read back
+type Compressor interface {
+	//Identifies the compressor in the file. It has to be unique and
+	//can't change once values are written with it
+	ID() uint8
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+//Values shorter than this aren't compressed unless Options.CompressMinSize
+//says otherwise
+const defaultCompressMinSize = 128
+
+var (
+	compressorsLock sync.RWMutex
+	compressors     = map[uint8]Compressor{}
+)
+
+//Makes values written by c readable. Registering another compressor with
+//the same ID replaces it
+func RegisterCompressor(c Compressor) {
+	compressorsLock.Lock()
+	defer compressorsLock.Unlock()
+	compressors[c.ID()] = c
+}
+
+func init() {
+	RegisterCompressor(FlateCompressor{})
+}
+
+//Compresses with compress/flate. Level is one of the compress/flate
+//levels, the zero value uses flate.DefaultCompression
+type FlateCompressor struct {
+	Level int
+}
+
+func (fc FlateCompressor) ID() uint8 {
+	return 1
+}
+
+func (fc FlateCompressor) Compress(data []byte) ([]byte, error) {
+	level := fc.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (fc FlateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (kh *KeyHandler) compress(data []byte) ([]byte, uint8, error) {
+	//Returns what to write for data and the flags for it. Small values and
+	//values that don't get smaller are kept as they are
+	if kh.compressor == nil || len(data) < kh.compressMin {
+		return data, 0, nil
+	}
+	compressed, err := kh.compressor.Compress(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(compressed)+1 >= len(data) {
+		return data, 0, nil
+	}
+	return append([]byte{kh.compressor.ID()}, compressed...), flagCompressed, nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("gokvlite: compressed value is empty: %w", ErrCorrupt)
+	}
+	compressorsLock.RLock()
+	c, ok := compressors[data[0]]
+	compressorsLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("gokvlite: no compressor registered with id %d", data[0])
+	}
+	return c.Decompress(data[1:])
+}
@@ -0,0 +1,126 @@
+package gokvlite
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+//reverses the bytes, which is enough to tell it was used
+type reverseCompressor struct{}
+
+func (rc reverseCompressor) ID() uint8 {
+	return 200
+}
+
+func (rc reverseCompressor) Compress(data []byte) ([]byte, error) {
+	out := make([]byte, len(data)/2)
+	for i := range out {
+		out[i] = data[len(data)-1-i]
+	}
+	return out, nil
+}
+
+func (rc reverseCompressor) Decompress(data []byte) ([]byte, error) {
+	out := make([]byte, len(data))
+	for i := range out {
+		out[i] = data[len(data)-1-i]
+	}
+	return append(out, out...), nil
+}
+
+func TestFlateCompressor(t *testing.T) {
+	data := []byte(strings.Repeat(`{"key": "value"}`, 100))
+	compressed, err := FlateCompressor{}.Compress(data)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(compressed) >= len(data) {
+		t.Fatalf("Data wasn't compressed")
+	}
+	data2, err := FlateCompressor{}.Decompress(compressed)
+	if err != nil || !bytes.Equal(data, data2) {
+		t.Fatalf("Incorrect data after decompressing: %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, &Options{Compressor: FlateCompressor{}})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	random := make([]byte, 1000)
+	rand.Read(random)
+	values := map[string][]byte{
+		"json":   []byte(strings.Repeat(`{"key": "value"}`, 100)),
+		"small":  []byte("small"),
+		"random": random,
+	}
+	for key, value := range values {
+		if err = kh.Set(key, value); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if kh.datalocs["json"].Flags&flagCompressed == 0 || kh.datalocs["json"].Data.Entry.Size >= 1600 {
+		t.Fatalf("Compressible value wasn't compressed")
+	}
+	if kh.datalocs["small"].Flags&flagCompressed != 0 || kh.datalocs["random"].Flags != 0 {
+		t.Fatalf("Small or incompressible values were compressed")
+	}
+
+	//Reading doesn't depend on the options
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for key, value := range values {
+		data, _, err := kh.Get(key)
+		if err != nil || !bytes.Equal(data, value) {
+			t.Fatalf("Incorrect data from Get for %s: %v", key, err)
+		}
+		data, err = kh.GetInto(key, []byte("prefix"))
+		if err != nil || !bytes.Equal(data, append([]byte("prefix"), value...)) {
+			t.Fatalf("Incorrect data from GetInto for %s: %v", key, err)
+		}
+		err = kh.View(key, func(data []byte) error {
+			if !bytes.Equal(data, value) {
+				t.Fatalf("Incorrect data from View for %s", key)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		r, err := kh.GetReader(key)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		data, _ = ioutil.ReadAll(r)
+		if !bytes.Equal(data, value) {
+			t.Fatalf("Incorrect data from GetReader for %s", key)
+		}
+	}
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, &Options{Compressor: reverseCompressor{}, CompressMinSize: 4})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("Testing", []byte("abcdabcd")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//Not registered yet
+	if _, _, err = kh.Get("Testing"); err == nil {
+		t.Fatalf("Expected an error for an unknown compressor")
+	}
+	RegisterCompressor(reverseCompressor{})
+	if data, _, err := kh.Get("Testing"); err != nil || string(data) != "abcdabcd" {
+		t.Fatalf("Incorrect data: %s %v", data, err)
+	}
+}
@@ -0,0 +1,422 @@
+package gokvlite
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var errInjected = errors.New("injected write failure")
+
+type pendingWrite struct {
+	off  int64
+	data []byte
+}
+
+//faultStorage is a Storage for testing what happens when writes fail.
+//Reads see every write that landed, while synced only has what was
+//there at the last Sync, which is what survives a power loss
+type faultStorage struct {
+	current *MemStorage
+	synced  *MemStorage
+	pending []pendingWrite
+	writes  int
+	//fails this WriteAt, counting from 1. 0 never fails
+	failAt int
+	//bytes of the failing write that land anyway
+	tear   int
+	failed bool
+}
+
+func newFaultStorage(data []byte) *faultStorage {
+	fs := new(faultStorage)
+	fs.current = NewMemStorage()
+	fs.synced = NewMemStorage()
+	fs.current.WriteAt(data, 0)
+	fs.synced.WriteAt(data, 0)
+	return fs
+}
+
+func (fs *faultStorage) ReadAt(p []byte, off int64) (int, error) {
+	return fs.current.ReadAt(p, off)
+}
+
+func (fs *faultStorage) WriteAt(p []byte, off int64) (int, error) {
+	//Once a write has failed the device is gone and nothing else lands
+	if fs.failed {
+		return 0, errInjected
+	}
+	fs.writes++
+	if fs.writes == fs.failAt {
+		fs.failed = true
+		if fs.tear < len(p) {
+			p = p[:fs.tear]
+		}
+		fs.apply(p, off)
+		return len(p), errInjected
+	}
+	fs.apply(p, off)
+	return len(p), nil
+}
+
+func (fs *faultStorage) apply(p []byte, off int64) {
+	fs.current.WriteAt(p, off)
+	fs.pending = append(fs.pending, pendingWrite{off, append([]byte{}, p...)})
+}
+
+func (fs *faultStorage) Size() (int64, error) {
+	return fs.current.Size()
+}
+
+func (fs *faultStorage) Sync() error {
+	if fs.failed {
+		return errInjected
+	}
+	for _, w := range fs.pending {
+		fs.synced.WriteAt(w.data, w.off)
+	}
+	fs.pending = nil
+	return nil
+}
+
+func (fs *faultStorage) Truncate(size int64) error {
+	//truncating is treated as durable right away
+	if err := fs.Sync(); err != nil {
+		return err
+	}
+	fs.current.Truncate(size)
+	return fs.synced.Truncate(size)
+}
+
+func (fs *faultStorage) Close() error {
+	return nil
+}
+
+func (fs *faultStorage) crash(keep int) *MemStorage {
+	//Returns what the storage holds after losing power, when only the
+	//first keep writes since the last Sync made it
+	ms := NewMemStorage()
+	ms.WriteAt(fs.synced.data, 0)
+	for i, w := range fs.pending {
+		if i >= keep {
+			break
+		}
+		ms.WriteAt(w.data, w.off)
+	}
+	return ms
+}
+
+func (fs *faultStorage) crashSubset(rnd *rand.Rand) *MemStorage {
+	//Returns what the storage holds after losing power, when any of the
+	//writes since the last Sync made it, in any order
+	ms := NewMemStorage()
+	ms.WriteAt(fs.synced.data, 0)
+	for _, i := range rnd.Perm(len(fs.pending)) {
+		if w := fs.pending[i]; rnd.Intn(2) == 0 {
+			ms.WriteAt(w.data, w.off)
+		}
+	}
+	return ms
+}
+
+func TestFaultStorage(t *testing.T) {
+	fs := newFaultStorage([]byte("0123456789"))
+	fs.failAt = 3
+	fs.tear = 2
+
+	if _, err := fs.WriteAt([]byte("a"), 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fs.Sync()
+	if _, err := fs.WriteAt([]byte("b"), 1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n, err := fs.WriteAt([]byte("cccc"), 2); n != 2 || err != errInjected {
+		t.Fatalf("Expected a torn write: %d %v", n, err)
+	}
+	if _, err := fs.WriteAt([]byte("d"), 9); err != errInjected {
+		t.Fatalf("Writes after a failure should fail")
+	}
+
+	b := make([]byte, 10)
+	fs.ReadAt(b, 0)
+	if string(b) != "abcc456789" {
+		t.Fatalf("Incorrect current data: %s", b)
+	}
+	fs.crash(0).ReadAt(b, 0)
+	if string(b) != "a123456789" {
+		t.Fatalf("Unsynced writes weren't dropped: %s", b)
+	}
+	fs.crash(1).ReadAt(b, 0)
+	if string(b) != "ab23456789" {
+		t.Fatalf("Incorrect data keeping one write: %s", b)
+	}
+}
+
+//A crashOp runs against a database holding base. changed has the value
+//each key it touches has afterwards, nil for deleted keys
+type crashOp struct {
+	name    string
+	run     func(kh *KeyHandler) error
+	changed map[string]*string
+}
+
+func strptr(s string) *string {
+	return &s
+}
+
+func crashBase(t *testing.T, base map[string]string, fill func(kh *KeyHandler) bool) []byte {
+	//Builds a database holding base. fill adds more keys to base while it
+	//returns true
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for key, value := range base {
+		if err = kh.Set(key, []byte(value)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	for i := 0; fill != nil && fill(kh); i++ {
+		//too long to be inline, so every key takes blocks
+		key := fmt.Sprintf("fill%d", i)
+		value := key + strings.Repeat(".", inlineSize)
+		if err = kh.Set(key, []byte(value)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		base[key] = value
+	}
+	return append([]byte{}, ms.data...)
+}
+
+func checkCrashed(storage Storage, base map[string]string, changed map[string]*string) error {
+	//Checks that every key has its base value or its changed value, then
+	//that the database can still be written without damaging them
+	kh, err := OpenStorage(storage, nil)
+	if err != nil {
+		return fmt.Errorf("reopening: %v", err)
+	}
+	check := func() error {
+		for key, value := range base {
+			data, found, err := kh.Get(key)
+			if err != nil {
+				return err
+			}
+			if found && string(data) == value {
+				continue
+			}
+			if after, ok := changed[key]; ok {
+				if after == nil && !found || after != nil && found && string(data) == *after {
+					continue
+				}
+			}
+			return fmt.Errorf("incorrect data for %s: %q %v", key, data, found)
+		}
+		for key, after := range changed {
+			if _, ok := base[key]; ok {
+				continue
+			}
+			data, found, err := kh.Get(key)
+			if err != nil {
+				return err
+			}
+			if found && (after == nil || string(data) != *after) {
+				return fmt.Errorf("incorrect data for new key %s: %q", key, data)
+			}
+		}
+		return nil
+	}
+	if err = check(); err != nil {
+		return err
+	}
+	versions := func() error {
+		//without KeepVersions an entry left by the crash is no version
+		for key, versions := range kh.history {
+			if len(versions) > 0 {
+				return fmt.Errorf("%d versions of %s kept", len(versions), key)
+			}
+		}
+		return nil
+	}
+	if err = versions(); err != nil {
+		return err
+	}
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("after%d", i)
+		if err = kh.Set(key, []byte(strings.Repeat(key, 10))); err != nil {
+			return err
+		}
+	}
+	for key := range changed {
+		if err = kh.Set(key, []byte("rewritten")); err != nil {
+			return err
+		}
+		changed[key] = strptr("rewritten")
+	}
+	if err = check(); err == nil {
+		err = versions()
+	}
+	if err != nil {
+		return fmt.Errorf("after writing: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("after%d", i)
+		data, _, err := kh.Get(key)
+		if err != nil || string(data) != strings.Repeat(key, 10) {
+			return fmt.Errorf("incorrect data for %s after writing: %q %v", key, data, err)
+		}
+	}
+	return nil
+}
+
+func crashPoints(total int) []int {
+	//Returns which writes to fail out of total. Long runs of writes are
+	//mostly the same, like writing out a new list, so only the start and
+	//end of them are tried every time
+	edge := 60
+	if testing.Short() {
+		edge = 20
+	}
+	var points []int
+	for n := 1; n <= total; n++ {
+		if n <= edge || n > total-edge || n%(total/edge+1) == 0 {
+			points = append(points, n)
+		}
+	}
+	return points
+}
+
+func runCrashOp(t *testing.T, data []byte, base map[string]string, op crashOp) {
+	//Fails every write op makes in turn, then checks the database after
+	//losing power with none, some or all of the unsynced writes
+	fs := newFaultStorage(data)
+	kh, err := OpenStorage(fs, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fs.writes = 0
+	if err = op.run(kh); err != nil {
+		t.Fatalf("%s: Error without failures: %v", op.name, err)
+	}
+	total := fs.writes
+
+	rnd := rand.New(rand.NewSource(int64(total)))
+	for _, n := range crashPoints(total) {
+		for _, tear := range []int{0, 1, 9} {
+			fs := newFaultStorage(data)
+			kh, err := OpenStorage(fs, nil)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			fs.writes = 0
+			fs.failAt = n
+			fs.tear = tear
+			if err = op.run(kh); !errors.Is(err, errInjected) {
+				t.Fatalf("%s: Expected the failed write %d to be returned: %v", op.name, n, err)
+			}
+
+			keep := rnd.Intn(len(fs.pending) + 1)
+			first := fmt.Sprintf("the first %d", keep)
+			crashes := map[string]*MemStorage{
+				"all":        fs.crash(len(fs.pending)),
+				"none":       fs.crash(0),
+				first:        fs.crash(keep),
+				"any":        fs.crashSubset(rnd),
+				"any others": fs.crashSubset(rnd),
+			}
+			for kept, storage := range crashes {
+				changed := make(map[string]*string)
+				for key, value := range op.changed {
+					changed[key] = value
+				}
+				if err = checkCrashed(storage, base, changed); err != nil {
+					t.Fatalf("%s: failing write %d of %d, tearing at %d, keeping %s of %d: %v",
+						op.name, n, total, tear, kept, len(fs.pending), err)
+				}
+			}
+		}
+	}
+}
+
+func TestCrashConsistency(t *testing.T) {
+	//same, grow and del start inline, and shrink ends inline
+	base := map[string]string{
+		"same":   "aaaa",
+		"grow":   "x",
+		"shrink": strings.Repeat("y", 100),
+		"del":    "gone",
+	}
+	data := crashBase(t, base, nil)
+
+	set := func(key string, value string) func(kh *KeyHandler) error {
+		return func(kh *KeyHandler) error {
+			return kh.Set(key, []byte(value))
+		}
+	}
+	ops := []crashOp{
+		{"new key", set("new", "value"), map[string]*string{"new": strptr("value")}},
+		{"same size", set("same", "bbbb"), map[string]*string{"same": strptr("bbbb")}},
+		{"grow", set("grow", strings.Repeat("x", 50)), map[string]*string{"grow": strptr(strings.Repeat("x", 50))}},
+		{"shrink", set("shrink", "y"), map[string]*string{"shrink": strptr("y")}},
+		{"del", func(kh *KeyHandler) error {
+			_, err := kh.Del("del")
+			return err
+		}, map[string]*string{"del": nil}},
+		{"reuse", func(kh *KeyHandler) error {
+			//frees blocks and takes them again, splitting the larger one
+			if _, err := kh.Del("shrink"); err != nil {
+				return err
+			}
+			return kh.Set("new", []byte(strings.Repeat("z", 20)))
+		}, map[string]*string{"shrink": nil, "new": strptr(strings.Repeat("z", 20))}},
+	}
+	for _, op := range ops {
+		runCrashOp(t, data, base, op)
+	}
+}
+
+func TestCrashMakeNewList(t *testing.T) {
+	base := map[string]string{"first": "1"}
+	data := crashBase(t, base, func(kh *KeyHandler) bool {
+		return kh.freeKeyInfos.Len() > 0
+	})
+	runCrashOp(t, data, base, crashOp{"makeNewList", func(kh *KeyHandler) error {
+		return kh.Set("new", []byte("value"))
+	}, map[string]*string{"new": strptr("value")}})
+}
+
+func TestCrashMakeNewBlockList(t *testing.T) {
+	base := map[string]string{"first": "1"}
+	data := crashBase(t, base, func(kh *KeyHandler) bool {
+		return kh.bli.Freeentries.Len() > 0
+	})
+	value := strings.Repeat("value", inlineSize)
+	runCrashOp(t, data, base, crashOp{"makeNewBlockList", func(kh *KeyHandler) error {
+		return kh.Set("new", []byte(value))
+	}, map[string]*string{"new": &value}})
+}
+
+func TestCrashCreate(t *testing.T) {
+	//Losing power while the file is created leaves something that can
+	//still be opened
+	fs := newFaultStorage(nil)
+	if _, err := OpenStorage(fs, nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	total := fs.writes
+	for _, n := range crashPoints(total) {
+		fs := newFaultStorage(nil)
+		fs.failAt = n
+		fs.tear = 3
+		if _, err := OpenStorage(fs, nil); !errors.Is(err, errInjected) {
+			t.Fatalf("Expected the failed write %d to be returned: %v", n, err)
+		}
+		if err := checkCrashed(fs.crash(len(fs.pending)), map[string]string{}, nil); err != nil {
+			t.Fatalf("failing write %d of %d: %v", n, total, err)
+		}
+	}
+}
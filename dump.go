@@ -0,0 +1,251 @@
+package gokvlite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"unicode/utf8"
+)
+
+//A dump is a copy of the keys and buckets of a database that doesn't
+//depend on the file format or the machine. It starts with this header,
+//followed by the same records as an incremental backup: a recordBucket
+//for each bucket, parents before their children and the KeyHandler's
+//own keys first, each followed by a recordSet for each of its keys in
+//order. Values are written as they are read, without compression or
+//encryption. After the recordEnd comes the CRC-32 (IEEE) of everything
+//before it. All numbers in fixed size fields are little endian
+type dumpHeader struct {
+	Magic   [8]byte
+	Version uint32
+}
+
+var dumpMagic = [8]byte{'g', 'k', 'v', 'l', 'd', 'u', 'm', 'p'}
+
+const dumpVersion = 1
+
+//A line of a JSON dump. The first line only has Version, the last one
+//only End, with the number of keys. The ones in between are either the
+//path of a bucket, which comes before the keys in it, or a key with the
+//path of its bucket if it's in one and its value in base64. Keys and
+//bucket names have to be valid UTF-8
+type jsonRecord struct {
+	Version int      `json:"gokvlite_dump,omitempty"`
+	Bucket  []string `json:"bucket,omitempty"`
+	Key     *string  `json:"key,omitempty"`
+	Value   *[]byte  `json:"value,omitempty"`
+	End     *int64   `json:"end,omitempty"`
+}
+
+//Writes a dump of every key and bucket to w, which Restore reads back
+//into any database. The dump is of the database as it was when Dump was
+//called, and writes to kh go on while it's written, like for Backup
+func (kh *KeyHandler) Dump(w io.Writer) error {
+	_, buckets, err := kh.pin(-1)
+	if err != nil {
+		return err
+	}
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	err = binary.Write(bw, binary.LittleEndian, dumpHeader{dumpMagic, dumpVersion})
+	if err == nil {
+		err = kh.writePinned(bw, buckets)
+	}
+	if err == nil {
+		bw.WriteByte(recordEnd)
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = binary.Write(w, binary.LittleEndian, crc.Sum32())
+	}
+	return kh.endPin(err)
+}
+
+//Reads from r and adds to a checksum what's read
+type checksumReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (cr *checksumReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.crc.Write(p[:n])
+	return n, err
+}
+
+func (cr *checksumReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+//Sets the keys in a dump written by Dump, creating the buckets they're
+//in. Keys that aren't in the dump are left as they are, so it's meant
+//for an empty database. The checksum is only checked at the end, so if
+//it doesn't match, or r ends early, the keys before are already set
+func (kh *KeyHandler) Restore(r io.Reader) error {
+	cr := &checksumReader{bufio.NewReader(r), crc32.NewIEEE()}
+	var header dumpHeader
+	if err := binary.Read(cr, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if header.Magic != dumpMagic || header.Version != dumpVersion {
+		return fmt.Errorf("dump: not a dump: %w", ErrCorrupt)
+	}
+
+	var store Store
+	for {
+		op, err := cr.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case recordEnd:
+			sum := cr.crc.Sum32()
+			var trailer uint32
+			if err = binary.Read(cr.r, binary.LittleEndian, &trailer); err != nil {
+				return err
+			}
+			if trailer != sum {
+				return fmt.Errorf("dump: checksum doesn't match: %w", ErrCorrupt)
+			}
+			return nil
+		case recordBucket:
+			path, err := readPath(cr)
+			if err != nil {
+				return err
+			}
+			if store, err = kh.restoreBucket(path); err != nil {
+				return err
+			}
+		case recordSet:
+			if store == nil {
+				return fmt.Errorf("dump: key before the first bucket: %w", ErrCorrupt)
+			}
+			key, err := readString(cr)
+			if err != nil {
+				return err
+			}
+			value, err := readString(cr)
+			if err != nil {
+				return err
+			}
+			if err = store.Set(key, []byte(value)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("dump: unknown record %d: %w", op, ErrCorrupt)
+		}
+	}
+}
+
+//Same as Dump, but writes JSON Lines with the values in base64, for
+//reading with other tools. See RestoreJSON
+func (kh *KeyHandler) DumpJSON(w io.Writer) error {
+	_, buckets, err := kh.pin(-1)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	err = enc.Encode(jsonRecord{Version: dumpVersion})
+	var count int64
+	for _, b := range buckets {
+		if err != nil {
+			break
+		}
+		err = kh.dumpJSON(enc, b, &count)
+	}
+	if err == nil {
+		err = enc.Encode(jsonRecord{End: &count})
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	return kh.endPin(err)
+}
+
+func (kh *KeyHandler) dumpJSON(enc *json.Encoder, b *pinnedBucket, count *int64) error {
+	//Writes the keys of a pinned bucket
+	if n := len(b.path); n > 0 {
+		//the names before it were checked with its parents
+		if !utf8.ValidString(b.path[n-1]) {
+			return fmt.Errorf("dump: bucket %q isn't valid UTF-8", b.path[n-1])
+		}
+		if err := enc.Encode(jsonRecord{Bucket: b.path}); err != nil {
+			return err
+		}
+	}
+	for _, key := range b.keys {
+		if !utf8.ValidString(key) {
+			return fmt.Errorf("dump: key %q isn't valid UTF-8", key)
+		}
+		info := b.changed[key]
+		data, err := kh.readPinned(&info)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			//written as "" rather than null
+			data = []byte{}
+		}
+		if err = enc.Encode(jsonRecord{Bucket: b.path, Key: &key, Value: &data}); err != nil {
+			return err
+		}
+		*count++
+	}
+	return nil
+}
+
+//Same as Restore, for a dump written by DumpJSON. The number of keys on
+//the last line is checked instead of a checksum
+func (kh *KeyHandler) RestoreJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	var header jsonRecord
+	if err := dec.Decode(&header); err != nil {
+		return err
+	}
+	if header.Version != dumpVersion {
+		return fmt.Errorf("dump: not a dump: %w", ErrCorrupt)
+	}
+
+	var store Store
+	var bucket string
+	var count int64
+	for {
+		var rec jsonRecord
+		err := dec.Decode(&rec)
+		switch {
+		case err == io.EOF:
+			return fmt.Errorf("dump: no end: %w", ErrCorrupt)
+		case err != nil:
+			return err
+		case rec.End != nil:
+			if *rec.End != count {
+				return fmt.Errorf("dump: %d keys, expected %d: %w", count, *rec.End, ErrCorrupt)
+			}
+			return nil
+		case (rec.Key == nil) != (rec.Value == nil), rec.Key == nil && len(rec.Bucket) == 0:
+			return fmt.Errorf("dump: line without a key and value: %w", ErrCorrupt)
+		}
+		if key := pathKey(rec.Bucket); store == nil || key != bucket {
+			if store, err = kh.restoreBucket(rec.Bucket); err != nil {
+				return err
+			}
+			bucket = key
+		}
+		if rec.Key == nil {
+			continue
+		}
+		if err = store.Set(*rec.Key, *rec.Value); err != nil {
+			return err
+		}
+		count++
+	}
+}
@@ -0,0 +1,123 @@
+package gokvlite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func fillDump(t *testing.T) *KeyHandler {
+	//Returns a database with keys in buckets, binary and empty values,
+	//and an empty bucket
+	kh, err := OpenStorage(NewMemStorage(), &Options{Compressor: FlateCompressor{}, CompressMinSize: 1})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("key", []byte(strings.Repeat("value", 100))); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("empty", nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.CreateBucket("a"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	b, err := kh.CreateBucket("a", "b")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = b.Set("binary", []byte{0, 1, 2, 255}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.CreateBucket("empty"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return kh
+}
+
+var dumpFormats = []struct {
+	dump    func(kh *KeyHandler, w io.Writer) error
+	restore func(kh *KeyHandler, r io.Reader) error
+}{
+	{(*KeyHandler).Dump, (*KeyHandler).Restore},
+	{(*KeyHandler).DumpJSON, (*KeyHandler).RestoreJSON},
+}
+
+func TestDump(t *testing.T) {
+	kh := fillDump(t)
+	want := fmt.Sprint(dumpAll(t, kh))
+
+	for i, format := range dumpFormats {
+		var buf bytes.Buffer
+		if err := format.dump(kh, &buf); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		restored, err := OpenStorage(NewMemStorage(), nil)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err = format.restore(restored, bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("Error restoring format %d: %v", i, err)
+		}
+		if got := fmt.Sprint(dumpAll(t, restored)); got != want {
+			t.Fatalf("Incorrect restore of format %d: %s, expected %s", i, got, want)
+		}
+
+		//a changed value, and a dump that's cut off
+		data := bytes.Replace(buf.Bytes(), []byte{0, 1, 2, 255}, []byte{0, 1, 2, 254}, 1)
+		if i == 1 {
+			data = bytes.Replace(buf.Bytes(), []byte(`"end":3`), []byte(`"end":4`), 1)
+		}
+		cut := buf.Bytes()[:buf.Len()-3]
+		for _, bad := range [][]byte{data, cut} {
+			restored, _ = OpenStorage(NewMemStorage(), nil)
+			if err = format.restore(restored, bytes.NewReader(bad)); err == nil {
+				t.Fatalf("Damaged dump of format %d restored", i)
+			}
+		}
+		restored, _ = OpenStorage(NewMemStorage(), nil)
+		if err = format.restore(restored, bytes.NewReader(data)); !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("Incorrect error for a changed dump of format %d: %v", i, err)
+		}
+	}
+
+	if err := kh.Set("\xff", nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err := kh.DumpJSON(new(bytes.Buffer)); err == nil {
+		t.Fatalf("Key that isn't UTF-8 written to JSON")
+	}
+}
+
+func TestDumpWriting(t *testing.T) {
+	kh := fillDump(t)
+	//enough to be written out in pieces, with writes in between
+	for i := 0; i < 20; i++ {
+		if err := kh.Set(fmt.Sprintf("key%d", i), []byte(strings.Repeat("a", 1000))); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	for i, format := range dumpFormats {
+		want := fmt.Sprint(dumpAll(t, kh))
+		w := &writingWriter{kh: kh}
+		if err := format.dump(kh, w); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if w.err != nil || w.writes < 2 {
+			t.Fatalf("Writing during the dump of format %d: %d %v", i, w.writes, w.err)
+		}
+		restored, err := OpenStorage(NewMemStorage(), nil)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if err = format.restore(restored, bytes.NewReader(w.buf.Bytes())); err != nil {
+			t.Fatalf("Error restoring format %d: %v", i, err)
+		}
+		if got := fmt.Sprint(dumpAll(t, restored)); got != want {
+			t.Fatalf("Incorrect restore of format %d: %s, expected %s", i, got, want)
+		}
+	}
+}
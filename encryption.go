@@ -0,0 +1,243 @@
+package gokvlite
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+)
+
+const (
+	nonceSize = 12
+	//a sealed empty value, which is just the nonce and the GCM tag
+	keyCheckSize = nonceSize + 16
+)
+
+var keyCheckData = []byte("gokvlite key check")
+
+//Seals and opens the data in blocks with AES-GCM. Each block is the nonce
+//followed by the sealed data. The first key seals, the others are only
+//tried when opening, for blocks an unfinished Rekey didn't get to
+type blockCipher struct {
+	keys []cipher.AEAD
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, nonceSize)
+}
+
+func sealedSize(c *blockCipher, size int64) int64 {
+	//Returns the size of the block needed for size bytes of data
+	if c == nil {
+		return size
+	}
+	return size + nonceSize + int64(c.keys[0].Overhead())
+}
+
+func (c *blockCipher) seal(data []byte) ([]byte, error) {
+	nonce := make([]byte, nonceSize, nonceSize+len(data)+c.keys[0].Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return c.keys[0].Seal(nonce, nonce, data, nil), nil
+}
+
+func (c *blockCipher) open(sealed []byte) ([]byte, error) {
+	if c == nil || len(sealed) < nonceSize {
+		return nil, ErrWrongKey
+	}
+	for _, key := range c.keys {
+		data, err := key.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+		if err == nil {
+			return data, nil
+		}
+	}
+	return nil, ErrWrongKey
+}
+
+func makeKeyCheck(key cipher.AEAD) ([keyCheckSize]byte, error) {
+	//Returns the record kept in the header to tell if a key is right
+	var check [keyCheckSize]byte
+	if _, err := io.ReadFull(rand.Reader, check[:nonceSize]); err != nil {
+		return check, err
+	}
+	key.Seal(check[:nonceSize], check[:nonceSize], nil, keyCheckData)
+	return check, nil
+}
+
+func checkKey(key cipher.AEAD, check [keyCheckSize]byte) bool {
+	_, err := key.Open(nil, check[:nonceSize], check[nonceSize:], keyCheckData)
+	return err == nil
+}
+
+func (kh *KeyHandler) setEncryption(opts *Options) error {
+	//Checks the key against the header, writing the key check if the file
+	//doesn't have one yet
+	header := kh.bli.fileheader
+	//an interrupted first Rekey leaves only Rekeycheck, with some of the
+	//values already sealed
+	encrypted := header.Keycheck != [keyCheckSize]byte{} || header.Rekeycheck != [keyCheckSize]byte{}
+	if opts.EncryptionKey == nil {
+		if encrypted {
+			return ErrWrongKey
+		}
+		return nil
+	}
+
+	key, err := newAEAD(opts.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	switch {
+	case checkKey(key, header.Keycheck):
+	case checkKey(key, header.Rekeycheck):
+		//the new key of an unfinished Rekey
+	case encrypted:
+		return ErrWrongKey
+	case !kh.readOnly:
+		header.Keycheck, err = makeKeyCheck(key)
+		if err != nil {
+			return err
+		}
+		if err = kh.bli.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	kh.cipher = &blockCipher{[]cipher.AEAD{key}}
+	if opts.PreviousEncryptionKey != nil {
+		previous, err := newAEAD(opts.PreviousEncryptionKey)
+		if err != nil {
+			return err
+		}
+		kh.cipher.keys = append(kh.cipher.keys, previous)
+	}
+	kh.encryptKeys = opts.EncryptKeys
+	return nil
+}
+
+func (kh *KeyHandler) blockCiphers(flags uint8) (keyCipher *blockCipher, dataCipher *blockCipher) {
+	//Returns the ciphers for the key and data blocks of an entry with flags
+	if flags&flagKeyEncrypted != 0 {
+		keyCipher = kh.cipher
+	}
+	if flags&flagEncrypted != 0 {
+		dataCipher = kh.cipher
+	}
+	return keyCipher, dataCipher
+}
+
+func (ks *keySpace) encryptFlags() uint8 {
+	//Returns the flags new entries of ks get for encryption. The keys of
+	//an index are the values it was built from, so they're always sealed
+	var flags uint8
+	if kh := ks.kh; kh.cipher != nil {
+		flags |= flagEncrypted
+		if kh.encryptKeys || ks.parent == kh.indexRoot {
+			flags |= flagKeyEncrypted
+		}
+	}
+	return flags
+}
+
+//Encrypts everything with newKey instead of the current key, or encrypts
+//the database if it isn't yet. Every value is rewritten and the blocks
+//they were in are zeroed, so this takes as long as copying the database.
+//If it's interrupted, open with Options.EncryptionKey set to newKey and
+//Options.PreviousEncryptionKey to the old key and call Rekey again to
+//finish. Returns ErrSnapshotOpen while a Snapshot is open or a Backup
+//runs
+func (kh *KeyHandler) Rekey(newKey []byte) error {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if err := kh.checkWrite(""); err != nil {
+		return err
+	}
+	if kh.bli.snapshots > 0 {
+		//the old blocks can't be zeroed while a snapshot reads them
+		return ErrSnapshotOpen
+	}
+	key, err := newAEAD(newKey)
+	if err != nil {
+		return err
+	}
+
+	header := kh.bli.fileheader
+	header.Rekeycheck, err = makeKeyCheck(key)
+	if err == nil {
+		err = kh.bli.writeHeader()
+	}
+	if err == nil {
+		err = kh.bli.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	//blocks are read with any of the keys and written with the new one
+	keys := []cipher.AEAD{key}
+	if kh.cipher != nil {
+		keys = append(keys, kh.cipher.keys...)
+	}
+	kh.cipher = &blockCipher{keys}
+	for _, ks := range kh.keySpaces() {
+		for key, info := range ks.datalocs {
+			info, err = ks.reseal(key, info)
+			if err != nil {
+				return err
+			}
+			ks.datalocs[key] = info
+		}
+		for key, versions := range ks.history {
+			for i, info := range versions {
+				info, err = ks.reseal(key, info)
+				if err != nil {
+					return err
+				}
+				versions[i] = info
+			}
+		}
+	}
+	//the old values are still in the blocks that were freed
+	if err = kh.bli.scrubFree(); err != nil {
+		return err
+	}
+	if err = kh.bli.file.Sync(); err != nil {
+		return err
+	}
+
+	header.Keycheck = header.Rekeycheck
+	header.Rekeycheck = [keyCheckSize]byte{}
+	if err = kh.bli.writeHeader(); err != nil {
+		return err
+	}
+	kh.cipher.keys = keys[:1]
+	return nil
+}
+
+func (ks *keySpace) reseal(key string, old *keyInfo) (*keyInfo, error) {
+	//Writes the version old of key again sealed with the current key,
+	//keeping its seq, and frees old
+	kh := ks.kh
+	flags := old.Flags&(flagCompressed|flagKeyEncrypted|flagVersioned) | ks.encryptFlags()
+	var size int64
+	var fill func(w io.WriterAt, info *keyInfo) error
+	if old.Flags&flagDeleted != 0 {
+		flags = kh.deletedFlags(key, flags) | old.Flags&flagVersioned
+	} else {
+		data, err := kh.rawValue(old)
+		if err != nil {
+			return nil, err
+		}
+		size, flags, fill = kh.dataWriter(key, data, flags)
+	}
+	info, err := ks.writeVersion(key, old, old.Seq, size, flags, flags&flagKeyEncrypted != 0, fill)
+	if err != nil {
+		return nil, err
+	}
+	return info, ks.release(old, info)
+}
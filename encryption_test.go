@@ -0,0 +1,284 @@
+package gokvlite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var (
+	testKey  = []byte("0123456789abcdef")
+	testKey2 = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func checkValues(t *testing.T, kh *KeyHandler, values map[string]string) {
+	for key, value := range values {
+		data, found, err := kh.Get(key)
+		if err != nil || !found || string(data) != value {
+			t.Fatalf("Incorrect data for %s: %q %v %v", key, data, found, err)
+		}
+		dst, err := kh.GetInto(key, nil)
+		if err != nil || string(dst) != value {
+			t.Fatalf("Incorrect data from GetInto for %s: %q %v", key, dst, err)
+		}
+		err = kh.View(key, func(data []byte) error {
+			if string(data) != value {
+				t.Fatalf("Incorrect data from View for %s: %q", key, data)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		r, err := kh.GetReader(key)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if data, err := ioutil.ReadAll(r); err != nil || string(data) != value {
+			t.Fatalf("Incorrect data from GetReader for %s: %q %v", key, data, err)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	ms := NewMemStorage()
+	opts := &Options{EncryptionKey: testKey, Compressor: FlateCompressor{}}
+	kh, err := OpenStorage(ms, opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	values := map[string]string{
+		"plain":      "secret value",
+		"compressed": strings.Repeat("secret value ", 100),
+		"streamed":   "streamed secret",
+		"empty":      "",
+	}
+	for key, value := range values {
+		if key == "streamed" {
+			err = kh.SetFromReader(key, strings.NewReader(value), int64(len(value)))
+		} else {
+			err = kh.Set(key, []byte(value))
+		}
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	checkValues(t, kh, values)
+	if bytes.Contains(ms.data, []byte("secret")) {
+		t.Fatalf("Values were written unencrypted")
+	}
+	if !bytes.Contains(ms.data, []byte("streamed")) {
+		t.Fatalf("Keys shouldn't be encrypted without EncryptKeys")
+	}
+
+	kh, err = OpenStorage(ms, opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkValues(t, kh, values)
+
+	if _, err = OpenStorage(ms, nil); err != ErrWrongKey {
+		t.Fatalf("Expected ErrWrongKey without a key: %v", err)
+	}
+	if _, err = OpenStorage(ms, &Options{EncryptionKey: testKey2}); err != ErrWrongKey {
+		t.Fatalf("Expected ErrWrongKey with the wrong key: %v", err)
+	}
+	if _, err = OpenStorage(NewMemStorage(), &Options{EncryptionKey: []byte("short")}); err == nil {
+		t.Fatalf("Expected an error for an invalid key")
+	}
+}
+
+func TestEncryptKeys(t *testing.T) {
+	ms := NewMemStorage()
+	opts := &Options{EncryptionKey: testKey, EncryptKeys: true}
+	kh, err := OpenStorage(ms, opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	values := map[string]string{"hiddenkey": "value", "otherkey": "other"}
+	for key, value := range values {
+		if err = kh.Set(key, []byte(value)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if bytes.Contains(ms.data, []byte("hiddenkey")) {
+		t.Fatalf("Keys were written unencrypted")
+	}
+	kh, err = OpenStorage(ms, opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkValues(t, kh, values)
+}
+
+func TestRekey(t *testing.T) {
+	//starts unencrypted, then encrypts and changes the key
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	values := map[string]string{"a": "secret a", "b": strings.Repeat("secret b", 50)}
+	for key, value := range values {
+		if err = kh.Set(key, []byte(value)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	if err = kh.Rekey(testKey); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkValues(t, kh, values)
+	if bytes.Contains(ms.data, []byte("secret")) {
+		t.Fatalf("Values weren't encrypted")
+	}
+	if _, err = OpenStorage(ms, nil); err != ErrWrongKey {
+		t.Fatalf("Expected ErrWrongKey without a key: %v", err)
+	}
+
+	kh, err = OpenStorage(ms, &Options{EncryptionKey: testKey, EncryptKeys: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Rekey(testKey2); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkValues(t, kh, values)
+	if _, err = OpenStorage(ms, &Options{EncryptionKey: testKey}); err != ErrWrongKey {
+		t.Fatalf("Expected ErrWrongKey with the old key: %v", err)
+	}
+	kh, err = OpenStorage(ms, &Options{EncryptionKey: testKey2})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkValues(t, kh, values)
+}
+
+func TestRekeyInterrupted(t *testing.T) {
+	data := crashBase(t, map[string]string{"a": "1", "b": "2", "c": "3"}, nil)
+	fs := newFaultStorage(data)
+	kh, err := OpenStorage(fs, &Options{EncryptionKey: testKey})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Rekey(testKey2); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data = append([]byte{}, fs.current.data...)
+
+	//fails partway through rewriting the values
+	fs = newFaultStorage(data)
+	kh, err = OpenStorage(fs, &Options{EncryptionKey: testKey2})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fs.writes = 0
+	fs.failAt = 8
+	if err = kh.Rekey(testKey); err != errInjected {
+		t.Fatalf("Expected the failed write: %v", err)
+	}
+
+	ms := fs.crash(len(fs.pending))
+	kh, err = OpenStorage(ms, &Options{EncryptionKey: testKey})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	wrong := 0
+	for _, key := range []string{"a", "b", "c"} {
+		if _, _, err = kh.Get(key); err == ErrWrongKey {
+			wrong++
+		}
+	}
+	if wrong == 0 {
+		t.Fatalf("Expected ErrWrongKey for values that weren't rewritten")
+	}
+	opts := &Options{EncryptionKey: testKey, PreviousEncryptionKey: testKey2}
+	kh, err = OpenStorage(ms, opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Rekey(testKey); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	kh, err = OpenStorage(ms, &Options{EncryptionKey: testKey})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkValues(t, kh, map[string]string{"a": "1", "b": "2", "c": "3"})
+}
+
+func TestRekeyFirstInterrupted(t *testing.T) {
+	values := map[string]string{"a": "1", "b": "2", "c": strings.Repeat("3", 100)}
+	data := crashBase(t, values, nil)
+	fs := newFaultStorage(data)
+	kh, err := OpenStorage(fs, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	fs.writes = 0
+	fs.failAt = 8
+	if err = kh.Rekey(testKey); err != errInjected {
+		t.Fatalf("Expected the failed write: %v", err)
+	}
+
+	//some of the values are sealed, so the key is needed
+	ms := fs.crash(len(fs.pending))
+	if _, err = OpenStorage(ms, nil); err != ErrWrongKey {
+		t.Fatalf("Opened without the key of an interrupted Rekey: %v", err)
+	}
+	if _, err = OpenStorage(ms, &Options{EncryptionKey: testKey2}); err != ErrWrongKey {
+		t.Fatalf("Opened with the wrong key: %v", err)
+	}
+	kh, err = OpenStorage(ms, &Options{EncryptionKey: testKey})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkValues(t, kh, values)
+	if err = kh.Rekey(testKey); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = OpenStorage(ms, nil); err != ErrWrongKey {
+		t.Fatalf("Opened without the key: %v", err)
+	}
+	kh, err = OpenStorage(ms, &Options{EncryptionKey: testKey})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkValues(t, kh, values)
+	kh.cipher = nil
+	if _, _, err = kh.Get("c"); err != ErrWrongKey {
+		t.Fatalf("Read a sealed value without the key: %v", err)
+	}
+}
+
+func TestEncryptIndex(t *testing.T) {
+	ms := NewMemStorage()
+	opts := &Options{EncryptionKey: testKey}
+	kh, err := OpenStorage(ms, opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	byEmail := func(key string, value []byte) []string {
+		return []string{string(value)}
+	}
+	if err = kh.CreateIndex("email", byEmail); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("user", []byte("hidden@example.com")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if bytes.Contains(ms.data, []byte("hidden@example.com")) {
+		t.Fatalf("Index keys were written unencrypted")
+	}
+	kh, err = OpenStorage(ms, opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.CreateIndex("email", byEmail); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if keys, err := kh.Query("email", "hidden@example.com"); err != nil || len(keys) != 1 || keys[0] != "user" {
+		t.Fatalf("Incorrect query: %q %v", keys, err)
+	}
+}
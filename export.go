@@ -0,0 +1,256 @@
+package gokvlite
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"unicode/utf8"
+)
+
+//How values are written in JSON Lines and CSV, see ExportJSONL and
+//ExportCSV
+type ValueEncoding int
+
+const (
+	//a JSON string, for values that are valid UTF-8. In CSV the value as
+	//it is
+	EncodingUTF8 ValueEncoding = iota
+	//a JSON string with the value in base64. In CSV the base64
+	EncodingBase64
+	//the value itself, for values that are valid JSON
+	EncodingJSON
+)
+
+func (e ValueEncoding) String() string {
+	switch e {
+	case EncodingUTF8:
+		return "utf8"
+	case EncodingBase64:
+		return "base64"
+	case EncodingJSON:
+		return "json"
+	}
+	return "unknown"
+}
+
+//A line of JSON Lines, see ExportJSONL
+type jsonLine struct {
+	Key   *string         `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+//Writes the keys of store and their values to w as CSV, with a header
+//row naming the key and value columns and the values written as enc
+//says. CSV readers, ImportCSV too, read a \r\n in a field as \n, so
+//values that have one, or that aren't text, need EncodingBase64 to be
+//read back as they were. Values have to be valid JSON for EncodingJSON
+func ExportCSV(store Store, w io.Writer, enc ValueEncoding) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"key", "value"})
+	err := store.ForEach(func(key string, data []byte) error {
+		value, err := encodeCSVValue(data, enc)
+		if err != nil {
+			return fmt.Errorf("export: value of %q: %w", key, err)
+		}
+		return cw.Write([]string{key, value})
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func encodeCSVValue(data []byte, enc ValueEncoding) (string, error) {
+	switch enc {
+	case EncodingUTF8:
+		return string(data), nil
+	case EncodingBase64:
+		return base64.StdEncoding.EncodeToString(data), nil
+	case EncodingJSON:
+		if !json.Valid(data) {
+			return "", errors.New("isn't valid JSON")
+		}
+		return string(data), nil
+	}
+	return "", fmt.Errorf("unknown encoding %d", enc)
+}
+
+//Sets the keys in CSV read from r, which has to start with a header row
+//with a key and a value column, as written by ExportCSV with the same
+//enc. Other columns are ignored. The keys are set one at a time, so if
+//it fails, the ones before are already set
+func ImportCSV(store Store, r io.Reader, enc ValueEncoding) error {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return err
+	}
+	keyColumn, valueColumn := -1, -1
+	for i, name := range header {
+		switch name {
+		case "key":
+			keyColumn = i
+		case "value":
+			valueColumn = i
+		}
+	}
+	if keyColumn < 0 || valueColumn < 0 {
+		return fmt.Errorf("import: no key and value columns in %q", header)
+	}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(row) <= max(keyColumn, valueColumn) {
+			line, _ := cr.FieldPos(0)
+			return fmt.Errorf("import: line %d: missing the key or value", line)
+		}
+		data, err := decodeCSVValue(row[valueColumn], enc)
+		if err != nil {
+			line, _ := cr.FieldPos(valueColumn)
+			return fmt.Errorf("import: line %d: %w", line, err)
+		}
+		if err = store.Set(row[keyColumn], data); err != nil {
+			return err
+		}
+	}
+}
+
+func decodeCSVValue(value string, enc ValueEncoding) ([]byte, error) {
+	switch enc {
+	case EncodingUTF8, EncodingJSON:
+		return []byte(value), nil
+	case EncodingBase64:
+		return base64.StdEncoding.DecodeString(value)
+	}
+	return nil, fmt.Errorf("unknown encoding %d", enc)
+}
+
+//Writes the keys of store and their values to w as JSON Lines, one
+//{"key": ..., "value": ...} object per key, with the values written as
+//enc says. Keys have to be valid UTF-8, and so do values for
+//EncodingUTF8. Values have to be valid JSON for EncodingJSON
+func ExportJSONL(store Store, w io.Writer, enc ValueEncoding) error {
+	bw := bufio.NewWriter(w)
+	err := store.ForEach(func(key string, data []byte) error {
+		if !utf8.ValidString(key) {
+			return fmt.Errorf("export: key %q isn't valid UTF-8", key)
+		}
+		value, err := encodeValue(data, enc)
+		if err != nil {
+			return fmt.Errorf("export: value of %q: %w", key, err)
+		}
+		line, err := json.Marshal(jsonLine{&key, value})
+		if err != nil {
+			return err
+		}
+		bw.Write(line)
+		return bw.WriteByte('\n')
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func encodeValue(data []byte, enc ValueEncoding) (json.RawMessage, error) {
+	switch enc {
+	case EncodingUTF8:
+		if !utf8.Valid(data) {
+			return nil, errors.New("isn't valid UTF-8")
+		}
+		return json.Marshal(string(data))
+	case EncodingBase64:
+		return json.Marshal(data)
+	case EncodingJSON:
+		if !json.Valid(data) {
+			return nil, errors.New("isn't valid JSON")
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %d", enc)
+}
+
+//Sets the keys in JSON Lines read from r, as written by ExportJSONL with
+//the same enc. For EncodingJSON the value is kept as it's written. The
+//keys are set one at a time, so if it fails, the ones before are
+//already set
+func ImportJSONL(store Store, r io.Reader, enc ValueEncoding) error {
+	dec := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var line jsonLine
+		err := dec.Decode(&line)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if line.Key == nil || line.Value == nil {
+			return fmt.Errorf("import: line %d: missing the key or value", n)
+		}
+		data, err := decodeValue(line.Value, enc)
+		if err != nil {
+			return fmt.Errorf("import: line %d: %w", n, err)
+		}
+		if err = store.Set(*line.Key, data); err != nil {
+			return err
+		}
+	}
+}
+
+func decodeValue(value json.RawMessage, enc ValueEncoding) ([]byte, error) {
+	switch enc {
+	case EncodingUTF8:
+		var s string
+		err := json.Unmarshal(value, &s)
+		return []byte(s), err
+	case EncodingBase64:
+		var data []byte
+		err := json.Unmarshal(value, &data)
+		return data, err
+	case EncodingJSON:
+		return value, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %d", enc)
+}
+
+//Returns a map with a copy of every key of store and its value
+func ExportMap(store Store) (map[string][]byte, error) {
+	m := make(map[string][]byte)
+	err := store.ForEach(func(key string, data []byte) error {
+		m[key] = append([]byte{}, data...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//Sets every key in m to its value in store, in key order. The keys are
+//set one at a time, so if it fails, the ones before are already set
+func ImportMap(store Store, m map[string][]byte) error {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := store.Set(key, m[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package gokvlite
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestExportImport(t *testing.T) {
+	values := map[string][]byte{
+		"text":   []byte("hello, \"world\"\nbye"),
+		"json":   []byte(`{"a":[1,2]}`),
+		"number": []byte("12"),
+		"empty":  {},
+	}
+	kh, err := OpenStorage(NewMemStorage(), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = ImportMap(kh, values); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	want := fmt.Sprintf("%q", values)
+
+	type format struct {
+		export func(store Store, w *bytes.Buffer) error
+		imp    func(store Store, r *bytes.Reader) error
+	}
+	formats := make(map[string]format)
+	for _, enc := range []ValueEncoding{EncodingUTF8, EncodingBase64, EncodingJSON} {
+		formats["csv "+enc.String()] = format{
+			func(store Store, w *bytes.Buffer) error { return ExportCSV(store, w, enc) },
+			func(store Store, r *bytes.Reader) error { return ImportCSV(store, r, enc) },
+		}
+		formats["jsonl "+enc.String()] = format{
+			func(store Store, w *bytes.Buffer) error { return ExportJSONL(store, w, enc) },
+			func(store Store, r *bytes.Reader) error { return ImportJSONL(store, r, enc) },
+		}
+	}
+
+	for name, f := range formats {
+		store := kh
+		if strings.HasSuffix(name, " json") {
+			//only values that are JSON
+			store, _ = OpenStorage(NewMemStorage(), nil)
+			store.Set("json", values["json"])
+			store.Set("number", values["number"])
+		}
+		var buf bytes.Buffer
+		if err = f.export(store, &buf); err != nil {
+			t.Fatalf("Error exporting %s: %v", name, err)
+		}
+		imported, _ := OpenStorage(NewMemStorage(), nil)
+		if err = f.imp(imported, bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatalf("Error importing %s: %v", name, err)
+		}
+		got, err := ExportMap(imported)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		expected, _ := ExportMap(store)
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", expected) {
+			t.Fatalf("Incorrect import of %s: %q, expected %q", name, got, expected)
+		}
+		if store == kh && fmt.Sprintf("%q", got) != want {
+			t.Fatalf("Incorrect import of %s: %q, expected %s", name, got, want)
+		}
+	}
+
+	if err = ExportJSONL(kh, new(bytes.Buffer), EncodingJSON); err == nil {
+		t.Fatalf("Value that isn't JSON exported")
+	}
+	kh.Set("binary", []byte{255})
+	if err = ExportJSONL(kh, new(bytes.Buffer), EncodingUTF8); err == nil {
+		t.Fatalf("Value that isn't UTF-8 exported")
+	}
+	if err = ExportCSV(kh, new(bytes.Buffer), EncodingJSON); err == nil {
+		t.Fatalf("Value that isn't JSON exported to CSV")
+	}
+	if err = ImportCSV(kh, strings.NewReader("key,value\na,!\n"), EncodingBase64); err == nil {
+		t.Fatalf("Value that isn't base64 imported")
+	}
+	if err = ImportCSV(kh, strings.NewReader("name,value\na,b\n"), EncodingUTF8); err == nil {
+		t.Fatalf("CSV without a key column imported")
+	}
+}
+
+func TestImportCSVColumns(t *testing.T) {
+	kh, err := OpenStorage(NewMemStorage(), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	err = ImportCSV(kh, strings.NewReader("value,id,key\n1,x,a\n2,y,b\n"), EncodingUTF8)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if m, _ := ExportMap(kh); len(m) != 2 || string(m["a"]) != "1" || string(m["b"]) != "2" {
+		t.Fatalf("Incorrect import: %q", m)
+	}
+}
+
+func TestCSVLineBreaks(t *testing.T) {
+	//CSV readers read \r\n in a field as \n, so only base64 keeps it
+	kh, err := OpenStorage(NewMemStorage(), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("crlf", []byte("a\r\nb\r")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for enc, want := range map[ValueEncoding]string{EncodingUTF8: "a\nb\r", EncodingBase64: "a\r\nb\r"} {
+		var buf bytes.Buffer
+		if err = ExportCSV(kh, &buf, enc); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		imported, _ := OpenStorage(NewMemStorage(), nil)
+		if err = ImportCSV(imported, &buf, enc); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if data, _, _ := imported.Get("crlf"); string(data) != want {
+			t.Fatalf("Incorrect value with %s: %q, expected %q", enc, data, want)
+		}
+	}
+}
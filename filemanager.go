@@ -4,15 +4,36 @@ import (
 	"container/list"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 )
 
 const freeBlockSize = 1024
 
+//Returned by readStorage when the file was never completely created
+var errUninitialized = errors.New("filemanager: file isn't initialized")
+
+//Changes whenever the layout of the file changes, see File format in
+//the README. The first layout didn't have a version, see Upgrade
+const formatVersion = 2
+
 type fileHeaderData struct {
+	//Version is first so that a torn header write leaves Freeblock_start
+	//zero rather than a header without a version
+	Version         int64
 	Freeblock_start int64
 	Data_start      int64
+	//The first key array of the bucket directory, 0 until a bucket is
+	//created
+	Buckets_start int64
+	//The last seq, when the entries may not have it anymore
+	Seq int64
+	//Empty for files that aren't encrypted, otherwise only the right key
+	//can open it
+	Keycheck [keyCheckSize]byte
+	//Set while Rekey is running, for the new key
+	Rekeycheck [keyCheckSize]byte
 }
 
 type blockListHeaderData struct {
@@ -37,24 +58,45 @@ func (info *blockListInfo) writeInfo(writer io.WriterAt) error {
 	return writeTo(writer, info.Location, info.Entry)
 }
 
-func (info *blockListInfo) ReadData(reader io.ReaderAt) (*[]byte, error) {
-	//Reads the data from the location specific in the info/entry
+func writeFlag(writer io.WriterAt, location int64, free uint8) error {
+	//Writes only the Free flag of the block list or key entry at location.
+	//A single byte can't be torn, so this is how entries are switched
+	//between used and free
+	_, err := writer.WriteAt([]byte{free}, location)
+	return err
+}
+
+func (info *blockListInfo) ReadData(reader io.ReaderAt, c *blockCipher) (*[]byte, error) {
+	//Reads the data from the location specific in the info/entry,
+	//decrypting it with c if it isn't nil
 	if info.Entry.Free > 0 {
-		return nil, errors.New("filemanager: ReadData: Info is free, unable to read")
+		return nil, fmt.Errorf("filemanager: ReadData: Info is free, unable to read: %w", ErrCorrupt)
 	}
 	data := make([]byte, info.Entry.Size)
 	_, err := reader.ReadAt(data, info.Entry.Start)
+	if err != nil || c == nil {
+		return &data, err
+	}
+	data, err = c.open(data)
 	return &data, err
 }
 
-func (info *blockListInfo) WriteData(writer io.WriterAt, data []byte) error {
-	//Writes the data to the location specified by the info/entry
-	if info.Entry.Free == 0 {
+func (info *blockListInfo) WriteData(writer io.WriterAt, c *blockCipher, data []byte) error {
+	//Writes the data to the location specified by the info/entry,
+	//encrypting it with c if it isn't nil. The size of the info has to
+	//be sealedSize of the data
+	if info.Entry.Free > 0 {
 		return errors.New("Info is free, unable to write")
 	}
-	if int64(binary.Size(data)) != info.Entry.Size {
+	if sealedSize(c, int64(len(data))) != info.Entry.Size {
 		return errors.New("Size of data is incorrect for size of info.")
 	}
+	if c != nil {
+		var err error
+		if data, err = c.seal(data); err != nil {
+			return err
+		}
+	}
 	_, err := writer.WriteAt(data, info.Entry.Start)
 	return err
 }
@@ -69,11 +111,19 @@ type blockListInterface struct {
 	 */
 
 	fileheader     *fileHeaderData
-	file           *os.File
+	file           Storage
+	mmap           bool
+	mapped         []byte
 	Blocklists     list.List
 	Freeblocks     list.List
 	Freeentries    list.List
 	BlockListInfos map[int64]*blockListInfo
+	//barrier does nothing, see Options.NoSync
+	noSync bool
+	//the number of open snapshots, and the blocks freed while there
+	//were any. They aren't reused until the last one is released
+	snapshots int
+	held      []*blockListInfo
 }
 
 func (bli *blockListInterface) getFileEnd() (int64, error) {
@@ -82,13 +132,75 @@ func (bli *blockListInterface) getFileEnd() (int64, error) {
 		return 0, err
 	}
 
-	fi, err := bli.file.Stat()
+	end, err := bli.file.Size()
 	if err != nil {
 		return 0, err
 	}
+	return end, bli.remap(end)
+}
+
+func (bli *blockListInterface) barrier() error {
+	//Makes the writes so far durable before any that come after. Entries
+	//are only switched between used and free once what they depend on is
+	//written, which needs those writes on the disk first, since it can
+	//write them in any order
+	if bli.noSync {
+		return nil
+	}
+	return bli.file.Sync()
+}
+
+func (bli *blockListInterface) writeHeader() error {
+	return writeTo(bli.file, 0, bli.fileheader)
+}
+
+func (bli *blockListInterface) remap(size int64) error {
+	//Grows the memory mapping to cover the first size bytes of the file
+	if !bli.mmap || size <= int64(len(bli.mapped)) {
+		return nil
+	}
+	if bli.mapped != nil {
+		if err := munmap(bli.mapped); err != nil {
+			return err
+		}
+		bli.mapped = nil
+	}
+	fs, ok := bli.file.(FileStorage)
+	if !ok {
+		return errors.New("gokvlite: mmap needs a FileStorage")
+	}
+	mapped, err := mmapFile(fs.File, size)
+	if err != nil {
+		return err
+	}
+	bli.mapped = mapped
+	return nil
+}
+
+func (bli *blockListInterface) slice(start int64, size int64) ([]byte, bool) {
+	//Returns the mapped bytes for the range, or false if it isn't mapped
+	if start < 0 || start+size > int64(len(bli.mapped)) {
+		return nil, false
+	}
+	return bli.mapped[start : start+size : start+size], true
+}
+
+func (bli *blockListInterface) ReadAt(p []byte, off int64) (int, error) {
+	//Reads from the mapping when possible, otherwise from the file
+	if data, ok := bli.slice(off, int64(len(p))); ok {
+		return copy(p, data), nil
+	}
+	return bli.file.ReadAt(p, off)
+}
 
-	end := fi.Size()
-	return end, err
+func (bli *blockListInterface) Close() error {
+	if bli.mapped != nil {
+		if err := munmap(bli.mapped); err != nil {
+			return err
+		}
+		bli.mapped = nil
+	}
+	return bli.file.Close()
 }
 
 func (bli *blockListInterface) makeNewBlockList() error {
@@ -96,11 +208,16 @@ func (bli *blockListInterface) makeNewBlockList() error {
 	if err != nil {
 		return err
 	}
-	manager, _, err := bli.newBlockList(bli.file, end, freeBlockSize)
+	//the new entries are only handed out once the list is linked in
+	var entries list.List
+	manager, _, err := bli.newBlockList(bli.file, end, freeBlockSize, &entries)
 	if err != nil {
 		return err
 	}
 
+	if err = bli.barrier(); err != nil {
+		return err
+	}
 	el := bli.Blocklists.Back()
 	if el != nil {
 		bl, ok := el.Value.(*blockListManager)
@@ -111,11 +228,13 @@ func (bli *blockListInterface) makeNewBlockList() error {
 		bl.header.Next = manager.headerStart
 		err = writeTo(bli.file, bl.headerStart, bl.header)
 		if err != nil {
+			bl.header.Next = 0
 			return err
 		}
 	}
 
 	bli.Blocklists.PushBack(manager)
+	bli.Freeentries.PushBackList(&entries)
 	return nil
 }
 
@@ -165,7 +284,12 @@ func (bli *blockListInterface) Resize(info *blockListInfo, size int64) (*blockLi
 
 	info.Entry.Size = size
 
+	//the smaller size is on the disk before anything else can point into
+	//the rest, so two blocks never overlap
 	err := info.writeInfo(bli.file)
+	if err == nil {
+		err = bli.barrier()
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -175,22 +299,48 @@ func (bli *blockListInterface) Resize(info *blockListInfo, size int64) (*blockLi
 		return nil, nil, err
 	}
 
+	//written as used first so a torn write can't leave a free block
+	//pointing at garbage, then set free
 	newinfo.Entry.Size = startingsize - size
-	newinfo.Entry.Free = 1
+	newinfo.Entry.Free = 0
 	newinfo.Entry.Start = info.Entry.Start + size
 	err = newinfo.writeInfo(bli.file)
 	if err != nil {
 		return nil, nil, err
 	}
-	bli.Freeblocks.PushBack(newinfo)
+	err = bli.setFree(newinfo)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	return info, newinfo, nil
 }
 
 func (bli *blockListInterface) SetFree(info *blockListInfo) error {
-	//Sets a blocklist as free
+	//Sets a blocklist as free. While a snapshot is open it's held
+	//instead, since the snapshot may still read it
+	if bli.snapshots > 0 {
+		bli.held = append(bli.held, info)
+		return nil
+	}
+	return bli.setFree(info)
+}
+
+func (bli *blockListInterface) freeHeld() error {
+	//Frees the blocks held for snapshots
+	for len(bli.held) > 0 {
+		if err := bli.setFree(bli.held[0]); err != nil {
+			return err
+		}
+		bli.held = bli.held[1:]
+	}
+	bli.held = nil
+	return nil
+}
+
+func (bli *blockListInterface) setFree(info *blockListInfo) error {
 	info.Entry.Free = 1
-	err := info.writeInfo(bli.file)
+	err := writeFlag(bli.file, info.Location, 1)
 	if err != nil {
 		return err
 	}
@@ -198,6 +348,27 @@ func (bli *blockListInterface) SetFree(info *blockListInfo) error {
 	return nil
 }
 
+func (bli *blockListInterface) scrubFree() error {
+	//Overwrites the data in every free block with zeros
+	zeros := make([]byte, 64*1024)
+	for e := bli.Freeblocks.Front(); e != nil; e = e.Next() {
+		info, ok := e.Value.(*blockListInfo)
+		if !ok {
+			return errors.New("Incorrect type in Freeblocks")
+		}
+		for off := int64(0); off < info.Entry.Size; off += int64(len(zeros)) {
+			n := info.Entry.Size - off
+			if n > int64(len(zeros)) {
+				n = int64(len(zeros))
+			}
+			if _, err := bli.file.WriteAt(zeros[:n], info.Entry.Start+off); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (bli *blockListInterface) GetFree(size int64) (*blockListInfo, error) {
 	//find a block large enough and resize it if it exists. Returns it marked as not free
 	for e := bli.Freeblocks.Front(); e != nil; e = e.Next() {
@@ -209,15 +380,17 @@ func (bli *blockListInterface) GetFree(size int64) (*blockListInfo, error) {
 		case info.Entry.Size == size:
 			info.Entry.Free = 0
 			bli.Freeblocks.Remove(e)
-			return info, nil
+			return info, writeFlag(bli.file, info.Location, 0)
 
 		case info.Entry.Size > size:
+			//marked used first so the smaller size is written along
+			//with the flag
+			info.Entry.Free = 0
+			bli.Freeblocks.Remove(e)
 			_, _, err := bli.Resize(info, size)
 			if err != nil {
 				return nil, err
 			}
-			info.Entry.Free = 0
-			bli.Freeblocks.Remove(e)
 			return info, nil
 		}
 	}
@@ -239,15 +412,21 @@ func (bli *blockListInterface) GetFree(size int64) (*blockListInfo, error) {
 
 	//Allocate the data storage
 	data := make([]byte, size)
-	bli.file.WriteAt(data, end)
+	_, err = bli.file.WriteAt(data, end)
+	if err != nil {
+		return nil, err
+	}
 
 	err = info.writeInfo(bli.file)
-	return info, err
+	if err != nil {
+		return info, err
+	}
+	return info, bli.remap(end + size)
 }
 
-func (bli *blockListInterface) newBlockList(w io.WriterAt, start int64, size int64) (*blockListManager, int64, error) {
+func (bli *blockListInterface) newBlockList(w io.WriterAt, start int64, size int64, entries *list.List) (*blockListManager, int64, error) {
 	//This creates a single unlinked blocklist
-	//Size is in number of items, not bytes
+	//Size is in number of items, not bytes. The new free entries are added to entries
 	var written int64
 
 	manager := new(blockListManager)
@@ -274,7 +453,7 @@ func (bli *blockListInterface) newBlockList(w io.WriterAt, start int64, size int
 		if err != nil {
 			return manager, written, err
 		}
-		bli.Freeentries.PushBack(&info)
+		entries.PushBack(&info)
 		bli.BlockListInfos[info.Location] = &info
 		written += int64(binary.Size(entry))
 
@@ -304,10 +483,10 @@ func (bli *blockListInterface) readBlockList(reader io.ReaderAt, start int64) (*
 		}
 
 		info := blockListInfo{data, start + read}
-		if data.Size == 0 {
+		if data.Free > 0 && data.Size == 0 {
 			bli.Freeentries.PushBack(&info)
 		} else if data.Free > 0 {
-			bli.Freeentries.PushBack(&info)
+			bli.Freeblocks.PushBack(&info)
 		}
 		bli.BlockListInfos[info.Location] = &info
 
@@ -316,6 +495,31 @@ func (bli *blockListInterface) readBlockList(reader io.ReaderAt, start int64) (*
 	return blm, nil
 }
 
+func (bli *blockListInterface) validBlockList(start int64, visited map[int64]bool) bool {
+	//Checks that a link points to a whole block list
+	header := new(blockListHeaderData)
+	size := int64(binary.Size(header)) + int64(binary.Size(blockListArrayEntryData{}))*freeBlockSize
+	end, err := bli.file.Size()
+	if err != nil || start <= 0 || start+size > end || visited[start] {
+		return false
+	}
+	if err = readFrom(bli.file, start, header); err != nil {
+		return false
+	}
+	return header.Size == freeBlockSize
+}
+
+func (bli *blockListInterface) usedStarts() map[int64]*blockListInfo {
+	//Returns the used blocks by where they start
+	starts := make(map[int64]*blockListInfo)
+	for _, info := range bli.BlockListInfos {
+		if info.Entry.Free == 0 && info.Entry.Size > 0 {
+			starts[info.Entry.Start] = info
+		}
+	}
+	return starts
+}
+
 func readFrom(r io.ReaderAt, start int64, data interface{}) error {
 	//This function reads any of the structs above and returns it
 	sr := io.NewSectionReader(r, start, int64(binary.Size(data)))
@@ -330,53 +534,85 @@ func writeTo(w io.WriterAt, start int64, data interface{}) error {
 
 func newFile(path string) (*os.File, *blockListInterface, error) {
 	//This function creates a new file and writes out the header and initial block list
-	bli := new(blockListInterface)
-	bli.BlockListInfos = make(map[int64]*blockListInfo)
-	file, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE, os.FileMode(0666))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, os.FileMode(0666))
 	if err != nil {
 		return file, nil, err
 	}
+	bli, err := newStorage(FileStorage{file})
+	return file, bli, err
+}
 
-	bli.file = file
-	header := fileHeaderData{0, 0}
+func newStorage(storage Storage) (*blockListInterface, error) {
+	//Writes out the header and initial block list to empty storage
+	bli := new(blockListInterface)
+	bli.BlockListInfos = make(map[int64]*blockListInfo)
+	bli.file = storage
+	header := fileHeaderData{Version: formatVersion}
 	bli.fileheader = &header
-	manager, written, err := bli.newBlockList(file, int64(binary.Size(header)), freeBlockSize)
+	manager, _, err := bli.newBlockList(storage, int64(binary.Size(header)), freeBlockSize, &bli.Freeentries)
 
 	if err != nil {
-		return file, bli, err
+		return bli, err
 	}
 
 	bli.Blocklists.PushBack(manager)
 
+	//Data_start is set once the first key list is made
 	header.Freeblock_start = int64(binary.Size(header))
-	header.Data_start = header.Freeblock_start + written
-	err = writeTo(file, 0, header)
-	return file, bli, err
+	err = writeTo(storage, 0, header)
+	return bli, err
 }
 
 func readFile(path string) (*os.File, *blockListInterface, error) {
-	bli := new(blockListInterface)
-	bli.BlockListInfos = make(map[int64]*blockListInfo)
 	file, err := os.OpenFile(path, os.O_RDWR, os.FileMode(0666))
 	if err != nil {
 		return file, nil, err
 	}
+	bli, err := readStorage(FileStorage{file})
+	return file, bli, err
+}
 
-	bli.file = file
+func readStorage(storage Storage) (*blockListInterface, error) {
+	//Reads the header and block lists of existing storage
+	bli := new(blockListInterface)
+	bli.BlockListInfos = make(map[int64]*blockListInfo)
+	bli.file = storage
 	header := new(fileHeaderData)
 	bli.fileheader = header
-	if err = readFrom(file, 0, header); err != nil {
-		return file, nil, err
+	if err := readFrom(storage, 0, header); err != nil {
+		return nil, err
+	}
+	if header.Version == legacyHeaderSize {
+		//the first layout starts with where its block list is, right
+		//after its header
+		return nil, ErrOldFormat
+	}
+	if header.Freeblock_start == 0 {
+		//the header is written last when creating
+		return nil, errUninitialized
+	}
+	if header.Version != formatVersion {
+		return nil, fmt.Errorf("filemanager: unsupported format version %d: %w", header.Version, ErrCorrupt)
+	}
+	blm, err := bli.readBlockList(storage, header.Freeblock_start)
+	if err != nil {
+		return nil, err
 	}
-	blm, err := bli.readBlockList(file, header.Freeblock_start)
 	bli.Blocklists.PushBack(blm)
+	visited := map[int64]bool{header.Freeblock_start: true}
 	for blm.header.Next != 0 {
-		blm, err = bli.readBlockList(file, blm.header.Next)
+		if !bli.validBlockList(blm.header.Next, visited) {
+			//A torn link to a list that was never used, drop it
+			blm.header.Next = 0
+			break
+		}
+		visited[blm.header.Next] = true
+		blm, err = bli.readBlockList(storage, blm.header.Next)
 		if err != nil {
-			return file, nil, err
+			return nil, err
 		}
 		bli.Blocklists.PushBack(blm)
 	}
 
-	return file, bli, err
+	return bli, nil
 }
@@ -0,0 +1,287 @@
+package gokvlite
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+//Index buckets are in the bucket directory under this id instead of a
+//real parent, so they're kept apart from the buckets callers make
+const indexParent int64 = -1
+
+//The key that marks an index as out of date. Index keys always start
+//with the length of the value, so none of them is empty
+const staleKey = ""
+
+type index struct {
+	ks *keySpace
+	fn func(key string, value []byte) []string
+	//the primary keys by index value
+	entries map[string]map[string]bool
+}
+
+func indexKey(value string, key string) string {
+	//Returns the key in the index bucket for key having value
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(value)+len(key))
+	n := binary.PutUvarint(buf, uint64(len(value)))
+	buf = append(buf[:n], value...)
+	return string(append(buf, key...))
+}
+
+func splitIndexKey(ikey string) (value string, key string, ok bool) {
+	n, size := binary.Uvarint([]byte(ikey))
+	if size <= 0 || uint64(len(ikey)-size) < n {
+		return "", "", false
+	}
+	return ikey[size : size+int(n)], ikey[size+int(n):], true
+}
+
+func (ix *index) values(key string, value []byte) map[string]bool {
+	//Returns the index values for key set to value
+	values := make(map[string]bool)
+	for _, v := range ix.fn(key, value) {
+		values[v] = true
+	}
+	return values
+}
+
+func (ix *index) load() {
+	//Builds entries from the keys in the index bucket
+	ix.entries = make(map[string]map[string]bool)
+	for ikey := range ix.ks.datalocs {
+		if value, key, ok := splitIndexKey(ikey); ok && ikey != staleKey {
+			ix.track(value, key)
+		}
+	}
+}
+
+func (ix *index) track(value string, key string) {
+	keys := ix.entries[value]
+	if keys == nil {
+		keys = make(map[string]bool)
+		ix.entries[value] = keys
+	}
+	keys[key] = true
+}
+
+func (ix *index) add(value string, key string) error {
+	if err := ix.ks.set(indexKey(value, key), nil); err != nil {
+		return err
+	}
+	ix.track(value, key)
+	return nil
+}
+
+func (ix *index) remove(value string, key string) error {
+	if _, err := ix.ks.del(indexKey(value, key)); err != nil {
+		return err
+	}
+	delete(ix.entries[value], key)
+	if len(ix.entries[value]) == 0 {
+		delete(ix.entries, value)
+	}
+	return nil
+}
+
+func (ix *index) stale() bool {
+	_, ok := ix.ks.datalocs[staleKey]
+	return ok
+}
+
+func (kh *KeyHandler) indexed(key string, value []byte, deleted bool, write func() error) error {
+	//Runs write, which sets key to value or deletes it, and updates the
+	//indexes to match. Entries for the new value are added before write
+	//and the ones for the old value are removed after it, so whichever
+	//write fails an index has every key it should. Query checks the keys
+	//it finds against their values, which drops the extra ones
+	if len(kh.indexRoot.children) == 0 {
+		return write()
+	}
+	if err := kh.checkWrite(key); err != nil {
+		return err
+	}
+	old, found, err := kh.get(key)
+	if err != nil {
+		return err
+	}
+
+	removed := make(map[*index][]string)
+	for name, ks := range kh.indexRoot.children {
+		ix := kh.indexes[name]
+		if ix == nil {
+			//It's in the file, but wasn't registered with CreateIndex
+			//since opening, so there's no way to update it
+			if _, ok := ks.datalocs[staleKey]; !ok {
+				if err = ks.set(staleKey, nil); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		oldValues := make(map[string]bool)
+		if found {
+			oldValues = ix.values(key, old)
+		}
+		newValues := make(map[string]bool)
+		if !deleted {
+			newValues = ix.values(key, value)
+		}
+		for v := range newValues {
+			if !oldValues[v] {
+				if err = ix.add(v, key); err != nil {
+					return err
+				}
+			}
+		}
+		for v := range oldValues {
+			if !newValues[v] {
+				removed[ix] = append(removed[ix], v)
+			}
+		}
+	}
+
+	if err = write(); err != nil {
+		return err
+	}
+	for ix, values := range removed {
+		for _, v := range values {
+			if err = ix.remove(v, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (kh *KeyHandler) buildIndex(name string, ix *index) error {
+	//Replaces the index bucket with a new one filled from every key. The
+	//new bucket is marked out of date before the directory points at it,
+	//and the mark is only removed once it's filled
+	if _, ok := kh.indexRoot.children[name]; ok {
+		if err := kh.indexRoot.dropBucket(name); err != nil {
+			return err
+		}
+	}
+	ks := kh.newKeySpace(nil)
+	err := ks.set(staleKey, nil)
+	if err != nil {
+		return err
+	}
+	if err = kh.writeBucket(indexParent, name, ks); err != nil {
+		return err
+	}
+	ks.name = name
+	ks.parent = kh.indexRoot
+	kh.indexRoot.children[name] = ks
+	ix.ks = ks
+	ix.entries = make(map[string]map[string]bool)
+
+	keys, err := kh.keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		value, _, err := kh.get(key)
+		if err != nil {
+			return err
+		}
+		for v := range ix.values(key, value) {
+			if err = ix.add(v, key); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = ks.del(staleKey)
+	return err
+}
+
+//Registers an index called name, which maps each key to the values fn
+//returns for it. Indexes are kept in the file and updated by every Set,
+//SetFromReader and Del of the KeyHandler's own keys, but fn can't be
+//saved, so it has to be registered again each time the file is opened.
+//Until then writes mark the index out of date, and registering it
+//rebuilds it. A new index is built from the keys already there. fn has
+//to return the same values for the same key and value; call
+//RebuildIndex after changing it
+func (kh *KeyHandler) CreateIndex(name string, fn func(key string, value []byte) []string) error {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if err := kh.indexRoot.checkBucket(name); err != nil {
+		return err
+	}
+	ix := &index{fn: fn}
+	kh.indexes[name] = ix
+	if ks, ok := kh.indexRoot.children[name]; ok {
+		ix.ks = ks
+		if !ix.stale() {
+			ix.load()
+			return nil
+		}
+	}
+	return kh.buildIndex(name, ix)
+}
+
+//Rebuilds the index called name from scratch. Returns ErrIndexNotFound
+//if it isn't registered
+func (kh *KeyHandler) RebuildIndex(name string) error {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if err := kh.checkWrite(name); err != nil {
+		return err
+	}
+	ix, ok := kh.indexes[name]
+	if !ok {
+		return ErrIndexNotFound
+	}
+	return kh.buildIndex(name, ix)
+}
+
+//Deletes the index called name from the file. Returns ErrIndexNotFound
+//if there isn't one
+func (kh *KeyHandler) DropIndex(name string) error {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if err := kh.checkWrite(name); err != nil {
+		return err
+	}
+	delete(kh.indexes, name)
+	err := kh.indexRoot.dropBucket(name)
+	if err == ErrBucketNotFound {
+		return ErrIndexNotFound
+	}
+	return err
+}
+
+//Returns the keys that the index called name maps to value, in order.
+//Returns ErrIndexNotFound if it isn't registered, or ErrIndexStale if
+//it has to be rebuilt
+func (kh *KeyHandler) Query(name string, value string) ([]string, error) {
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	if kh.closed {
+		return nil, ErrClosed
+	}
+	ix, ok := kh.indexes[name]
+	if !ok {
+		return nil, ErrIndexNotFound
+	}
+	if ix.stale() {
+		return nil, ErrIndexStale
+	}
+
+	keys := make([]string, 0, len(ix.entries[value]))
+	for key := range ix.entries[value] {
+		data, found, err := kh.get(key)
+		if err != nil {
+			return nil, err
+		}
+		//a failed write can leave entries for values the key doesn't
+		//have anymore
+		if found && ix.values(key, data)[value] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,215 @@
+package gokvlite
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+//indexes values like "color,size" by color
+func byColor(key string, value []byte) []string {
+	if len(value) == 0 {
+		return nil
+	}
+	return []string{strings.Split(string(value), ",")[0]}
+}
+
+func checkQuery(t *testing.T, kh *KeyHandler, value string, expected string) {
+	keys, err := kh.Query("color", value)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if strings.Join(keys, ",") != expected {
+		t.Fatalf("Incorrect keys for %q: %v, expected %s", value, keys, expected)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	kh.Set("apple", []byte("red,small"))
+	kh.Set("cherry", []byte("red,tiny"))
+	if _, err = kh.Query("color", "red"); err != ErrIndexNotFound {
+		t.Fatalf("Expected ErrIndexNotFound: %v", err)
+	}
+
+	//a new index is built from the keys already there
+	if err = kh.CreateIndex("color", byColor); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkQuery(t, kh, "red", "apple,cherry")
+
+	kh.Set("banana", []byte("yellow,long"))
+	kh.Set("cherry", []byte("black,tiny"))
+	kh.SetFromReader("plum", strings.NewReader("black,round"), 11)
+	kh.Del("apple")
+	checkQuery(t, kh, "red", "")
+	checkQuery(t, kh, "black", "cherry,plum")
+	checkQuery(t, kh, "yellow", "banana")
+	if keys, _ := kh.Keys(); strings.Join(keys, ",") != "banana,cherry,plum" {
+		t.Fatalf("Index keys are visible: %v", keys)
+	}
+	if names, _ := kh.Buckets(); len(names) != 0 {
+		t.Fatalf("Index buckets are visible: %v", names)
+	}
+
+	//the index is kept, but has to be registered again
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.Query("color", "black"); err != ErrIndexNotFound {
+		t.Fatalf("Expected ErrIndexNotFound before registering: %v", err)
+	}
+	if err = kh.CreateIndex("color", byColor); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkQuery(t, kh, "black", "cherry,plum")
+
+	//writes before registering mark it out of date, so it's rebuilt
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	kh.Set("grape", []byte("black,round"))
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.CreateIndex("color", byColor); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkQuery(t, kh, "black", "cherry,grape,plum")
+
+	//values can have any bytes in them
+	kh.Set("odd", []byte("bl\x00ack,x"))
+	checkQuery(t, kh, "bl\x00ack", "odd")
+	checkQuery(t, kh, "bl", "")
+
+	if err = kh.RebuildIndex("color"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkQuery(t, kh, "black", "cherry,grape,plum")
+	if err = kh.DropIndex("color"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.Query("color", "black"); err != ErrIndexNotFound {
+		t.Fatalf("Expected ErrIndexNotFound after dropping: %v", err)
+	}
+	if err = kh.DropIndex("color"); err != ErrIndexNotFound {
+		t.Fatalf("Expected ErrIndexNotFound: %v", err)
+	}
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(kh.indexRoot.children) != 0 {
+		t.Fatalf("Index wasn't dropped from the file")
+	}
+}
+
+func TestIndexLongKey(t *testing.T) {
+	//index keys hold the value and the key, so they can be longer than
+	//MaxKeySize
+	kh, err := OpenStorage(NewMemStorage(), &Options{MaxKeySize: 40})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.CreateIndex("color", byColor); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	key := strings.Repeat("k", 40)
+	if err = kh.Set(key, []byte("red,small")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkQuery(t, kh, "red", key)
+	if err = kh.Set(key+"k", []byte("red,small")); !errors.As(err, new(*KeyTooLargeError)) {
+		t.Fatalf("Expected KeyTooLargeError: %v", err)
+	}
+	if _, err = kh.Del(key); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkQuery(t, kh, "red", "")
+}
+
+func TestCrashIndex(t *testing.T) {
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	kh.Set("apple", []byte("red,small"))
+	kh.Set("cherry", []byte("red,tiny"))
+	if err = kh.CreateIndex("color", byColor); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data := append([]byte{}, ms.data...)
+
+	ops := []func(kh *KeyHandler) error{
+		func(kh *KeyHandler) error {
+			return kh.Set("apple", []byte("green,small"))
+		},
+		func(kh *KeyHandler) error {
+			_, err := kh.Del("cherry")
+			return err
+		},
+		func(kh *KeyHandler) error {
+			return kh.RebuildIndex("color")
+		},
+	}
+	for i, op := range ops {
+		fs := newFaultStorage(data)
+		kh, err := OpenStorage(fs, nil)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		kh.CreateIndex("color", byColor)
+		fs.writes = 0
+		if err = op(kh); err != nil {
+			t.Fatalf("op %d: Error without failures: %v", i, err)
+		}
+		total := fs.writes
+
+		for _, n := range crashPoints(total) {
+			fs := newFaultStorage(data)
+			kh, err := OpenStorage(fs, nil)
+			if err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			kh.CreateIndex("color", byColor)
+			fs.writes = 0
+			fs.failAt = n
+			fs.tear = 1
+			//blocks are freed in map order, so the number of writes can
+			//change by a few between runs
+			if err = op(kh); err != nil && !errors.Is(err, errInjected) {
+				t.Fatalf("op %d: Expected the failed write %d to be returned: %v", i, n, err)
+			}
+
+			for _, keep := range []int{len(fs.pending), 0} {
+				kh, err := OpenStorage(fs.crash(keep), nil)
+				if err != nil {
+					t.Fatalf("op %d: failing write %d: Error reopening: %v", i, n, err)
+				}
+				if err = kh.CreateIndex("color", byColor); err != nil {
+					t.Fatalf("op %d: failing write %d: Error: %v", i, n, err)
+				}
+				//every key the index returns, and no other, has the value
+				for _, color := range []string{"red", "green"} {
+					var expected []string
+					keys, _ := kh.Keys()
+					for _, key := range keys {
+						value, _, _ := kh.Get(key)
+						if byColor(key, value)[0] == color {
+							expected = append(expected, key)
+						}
+					}
+					checkQuery(t, kh, color, strings.Join(expected, ","))
+				}
+			}
+		}
+	}
+}
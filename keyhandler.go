@@ -1,13 +1,27 @@
 package gokvlite
 
 import (
+	"bytes"
 	"container/list"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"unsafe"
 )
 
 const keyblocksize = 500
 
+//Keys longer than this are rejected with a KeyTooLargeError, unless
+//Options.MaxKeySize is set
+const maxKeySize = 65535
+
+//Keys and values that fit in this many bytes together are stored in the
+//key entry itself instead of in blocks of their own
+const inlineSize = 32
+
 type keyArrayHeader struct {
 	Next int64
 	Size int64
@@ -16,6 +30,8 @@ type keyArrayHeader struct {
 type keyArrayHeaderInfo struct {
 	Header   *keyArrayHeader
 	Location int64
+	//the block the array is in
+	Block *blockListInfo
 }
 
 type keyInfo struct {
@@ -23,267 +39,1063 @@ type keyInfo struct {
 	Location int64
 	Key      *blockListInfo
 	Data     *blockListInfo
+	Flags    uint8
+	//the value of an inline entry, which has no Key or Data blocks
+	Inline []byte
+	//the write that made this version of the key, see KeyHandler.Seq
+	Seq int64
 }
 
+//Flags for how the data of a key is stored
+const (
+	//the data is a compressor id followed by the compressed value
+	flagCompressed uint8 = 1 << iota
+	//the data block is sealed with the encryption key
+	flagEncrypted
+	//the key block is sealed with the encryption key
+	flagKeyEncrypted
+	//the key and data are in the entry rather than in blocks
+	flagInline
+	//the key was deleted. The entry is kept as a version and has no data
+	flagDeleted
+	//the entries the key had before this one are kept as versions
+	flagVersioned
+)
+
 type keyEntry struct {
 	//This represents the key/data in the array on disk for reading when building the index
 	Free    uint8
+	Flags   uint8
+	Keylen  uint32
 	Keyloc  int64
 	Dataloc int64
+	Seq     int64
+	//the length of the value of an inline entry, Inline holds the key
+	//followed by the value
+	Datalen uint8
+	Inline  [inlineSize]byte
 }
 
-func (ki *keyInfo) Free(kh *KeyHandler) error {
-	//Frees a key (delete)
-	bli := kh.bli
-	err := bli.SetFree(ki.Key)
-	if err != nil {
-		return err
-	}
-	err = bli.SetFree(ki.Data)
-	if err != nil {
+func (ki *keyInfo) freeEntry(bli *blockListInterface) error {
+	//Marks the entry free. An inline entry is then zeroed so the old key
+	//and value don't stay in the key array
+	err := writeFlag(bli.file, ki.Location, 1)
+	if err != nil || ki.Flags&flagInline == 0 {
 		return err
 	}
+	return writeTo(bli.file, ki.Location, keyEntry{Free: 1})
+}
 
-	ke := keyEntry{1, 0, 0}
-	err = writeTo(bli.file, ki.Location, ke)
+func (ki *keyInfo) writeEntry(bli *blockListInterface, key string) error {
+	//Writes the locations with the entry still marked free, then marks it
+	//used. A torn write leaves the entry free instead of pointing at garbage
+	ke := keyEntry{Free: 1, Flags: ki.Flags, Keylen: uint32(len(key)), Seq: ki.Seq}
+	if ki.Flags&flagInline != 0 {
+		ke.Datalen = uint8(len(ki.Inline))
+		copy(ke.Inline[copy(ke.Inline[:], key):], ki.Inline)
+	} else {
+		ke.Keyloc = ki.Key.Location
+	}
+	if ki.Data != nil {
+		ke.Dataloc = ki.Data.Location
+	}
+	err := writeTo(bli.file, ki.Location, ke)
 	if err == nil {
+		err = bli.barrier()
+	}
+	if err != nil {
 		return err
 	}
-	ki.Key = nil
-	ki.Data = nil
-	kh.freeKeyInfos.PushBack(&ki)
-	return nil
+	return writeFlag(bli.file, ki.Location, 0)
 }
 
-func (ki *keyInfo) Update(bli *blockListInterface, key string, data []byte) error {
-	var err error
-	save := false
-	keysize := int64(binary.Size([]byte(key)))
-	datasize := int64(binary.Size(data))
-	if ki.Key == nil {
-		save = true
-		ki.Key, err = bli.GetFree(keysize)
-		if err != nil {
-			return err
-		}
-	} else if keysize != ki.Key.Entry.Size {
-		//have to resize if the size of the string or data don't match the current size
-		ki.Key, _, err = bli.Resize(ki.Key, keysize)
-		if err != nil {
-			return err
-		}
-		save = true
+//A keySpace is a set of keys with its own chain of key arrays. The
+//KeyHandler has one for its own keys and each bucket has another
+type keySpace struct {
+	kh           *KeyHandler
+	datalocs     map[string]*keyInfo
+	freeKeyInfos list.List
+	keyHeaders   list.List
+	//the header field that points to the first key array. It's nil
+	//when something else keeps track of where the chain starts
+	root *int64
+	//put in front of keys in the value cache, since keys are only
+	//unique within a keySpace
+	cacheID string
+	dropped bool
+	//where the keySpace is in the bucket tree. The KeyHandler's own
+	//keySpace is the top, and its children are the top level buckets
+	name     string
+	parent   *keySpace
+	children map[string]*keySpace
+	//the id of a keySpace without a parent, see id
+	topID int64
+	//the earlier versions of each key, oldest first. It's nil unless
+	//Options.KeepVersions is set, and only the KeyHandler's own keys
+	//have versions
+	history map[string][]*keyInfo
+}
+
+//This struct actually sets/gets/deletes a key from the database
+type KeyHandler struct {
+	keySpace
+	bli         *blockListInterface
+	readOnly    bool
+	closed      bool
+	cache       *valueCache
+	compressor  Compressor
+	compressMin int
+	maxKeySize  int
+	cipher      *blockCipher
+	encryptKeys bool
+	//the bucket directory, nil until the first bucket is created
+	dir    *keySpace
+	spaces uint32
+	//holds the index buckets, see indexParent
+	indexRoot *keySpace
+	indexes   map[string]*index
+	//holds the change log and the position of a follower, see
+	//changeLogParent
+	changeRoot *keySpace
+	changes    *changeLog
+	//writes other than the ones Follow applies fail, see Options.Follower
+	follower bool
+	applying bool
+	//the last write, see Seq
+	seq          int64
+	keepVersions int
+	watchers     []*Watcher
+	watchBuffer  int
+	//Readers share the lock, anything that changes the file or the
+	//maps above takes it exclusively
+	lock sync.RWMutex
+}
+
+func (kh *KeyHandler) newKeySpace(root *int64) *keySpace {
+	ks := new(keySpace)
+	kh.initKeySpace(ks, root)
+	return ks
+}
+
+func (kh *KeyHandler) initKeySpace(ks *keySpace, root *int64) {
+	ks.kh = kh
+	ks.root = root
+	ks.datalocs = make(map[string]*keyInfo)
+	ks.children = make(map[string]*keySpace)
+	//the same length for every keySpace, so no two can make the same
+	//cache key
+	id := make([]byte, 4)
+	binary.LittleEndian.PutUint32(id, kh.spaces)
+	ks.cacheID = string(id)
+	kh.spaces++
+}
+
+func (kh *KeyHandler) checkWrite(key string) error {
+	//Returns the error a write to key should fail with, if any
+	switch {
+	case kh.closed:
+		return ErrClosed
+	case kh.readOnly, kh.follower && !kh.applying:
+		return ErrReadOnly
+	case len(key) > kh.maxKeySize:
+		return &KeyTooLargeError{len(key), kh.maxKeySize}
 	}
+	return nil
+}
 
-	if ki.Data == nil {
-		save = true
-		ki.Data, err = bli.GetFree(datasize)
-		if err != nil {
-			return err
-		}
-	} else if datasize != ki.Data.Entry.Size {
-		ki.Data, _, err = bli.Resize(ki.Data, datasize)
-		if err != nil {
-			return err
-		}
-		save = true
+func (kh *KeyHandler) setMmap(enabled bool) error {
+	//Turns on reading through a memory mapping and maps the current file
+	if !enabled {
+		return nil
 	}
+	kh.bli.mmap = true
+	_, err := kh.bli.getFileEnd()
+	return err
+}
 
-	err = writeTo(bli.file, ki.Key.Entry.Start, []byte(key))
-	if err != nil {
-		return err
+func (ks *keySpace) checkWrite(key string) error {
+	if ks.parent != nil && ks.parent == ks.kh.indexRoot {
+		//index keys are longer than the keys they're for, which were
+		//checked already
+		key = ""
 	}
-	err = writeTo(bli.file, ki.Data.Entry.Start, data)
-	if err != nil {
+	if err := ks.kh.checkWrite(key); err != nil {
 		return err
 	}
-
-	ke := keyEntry{0, ki.Key.Location, ki.Data.Location}
-	if save {
-		err = writeTo(bli.file, ki.Location, ke)
-		return err
+	if ks.dropped {
+		return ErrBucketNotFound
 	}
 	return nil
 }
 
-//This struct actually sets/gets/deletes a key from the database
-type KeyHandler struct {
-	datalocs     map[string]*keyInfo
-	bli          *blockListInterface
-	freeKeyInfos list.List
-	keyHeaders   list.List
+func (ks *keySpace) lookup(key string) (*keyInfo, error) {
+	//Returns the info for an existing key
+	switch {
+	case ks.kh.closed:
+		return nil, ErrClosed
+	case ks.dropped:
+		return nil, ErrBucketNotFound
+	}
+	info, ok := ks.datalocs[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return info, nil
 }
 
-func (kh *KeyHandler) makeNewList() error {
+func (ks *keySpace) makeNewList() error {
+	bli := ks.kh.bli
 	header := keyArrayHeader{0, keyblocksize}
-	blankKeyEntry := keyEntry{1, 0, 0}
+	blankKeyEntry := keyEntry{Free: 1}
 	size := int64(binary.Size(header)) + (int64(binary.Size(blankKeyEntry)) * keyblocksize)
-	free, err := kh.bli.GetFree(size)
+	free, err := bli.GetFree(size)
 	if err != nil {
 		return err
 	}
 
 	offset := free.Entry.Start
 	//write the header
-	err = writeTo(kh.bli.file, offset, header)
+	err = writeTo(bli.file, offset, header)
 	if err != nil {
 		return err
 	}
 	offset += int64(binary.Size(header))
 
-	//write the entries and create the free infos to write out
+	//write the entries and create the free infos to write out. They're
+	//only handed out once the list is linked in
+	var infos list.List
 	entrysize := int64(binary.Size(blankKeyEntry))
 	for i := 0; i < keyblocksize; i++ {
-		info := keyInfo{offset, nil, nil}
-		err = writeTo(kh.bli.file, offset, blankKeyEntry)
+		info := keyInfo{Location: offset}
+		err = writeTo(bli.file, offset, blankKeyEntry)
 		if err != nil {
 			return err
 		}
 		offset += entrysize
-		kh.freeKeyInfos.PushBack(&info)
+		infos.PushBack(&info)
 	}
 
-	headerinfo := keyArrayHeaderInfo{&header, free.Entry.Start}
-	el := kh.keyHeaders.Back()
-	if el == nil {
+	headerinfo := keyArrayHeaderInfo{&header, free.Entry.Start, free}
+	if err = bli.barrier(); err != nil {
+		return err
+	}
+	el := ks.keyHeaders.Back()
+	if el == nil && ks.root != nil {
 		//empty list
-		kh.keyHeaders.PushBack(&headerinfo)
 		//update the file header since this is the first list
-		var fileheader fileHeaderData
-		err := readFrom(kh.bli.file, 0, &fileheader)
+		*ks.root = headerinfo.Location
+		err = bli.writeHeader()
 		if err != nil {
+			*ks.root = 0
+			return err
+		}
+	} else if el != nil {
+		last, ok := el.Value.(*keyArrayHeaderInfo)
+		if !ok {
+			return errors.New("Invalid type for headerinfo in makenewlist:")
+		}
+		last.Header.Next = headerinfo.Location
+		err = writeTo(bli.file, last.Location, last.Header)
+		if err != nil {
+			last.Header.Next = 0
 			return err
 		}
-		fileheader.Data_start = headerinfo.Location
-		err = writeTo(kh.bli.file, 0, &fileheader)
-		return err
-	}
-	last, ok := el.Value.(*keyArrayHeaderInfo)
-	if !ok {
-		return errors.New("Invalid type for headerinfo in makenewlist:")
-	}
-	last.Header.Next = headerinfo.Location
-	err = writeTo(kh.bli.file, last.Location, last.Header)
-	if err != nil {
-		return err
 	}
-	kh.keyHeaders.PushBack(&headerinfo)
+	ks.keyHeaders.PushBack(&headerinfo)
+	ks.freeKeyInfos.PushBackList(&infos)
 	return nil
 }
 
-func (kh *KeyHandler) readFile(start int64) error {
-	//Reads a file and builds out the keyHandler. Expects that bli exists on the KeyHandler.
-	header := keyArrayHeader{0, keyblocksize}
-	err := readFrom(kh.bli.file, start, &header)
-	if err != nil {
-		return err
-	}
-
-	headerInfo := keyArrayHeaderInfo{&header, start}
-	kh.keyHeaders.PushBack(&headerInfo)
-	offset := int64(binary.Size(header))
+func (ks *keySpace) readFile(start int64, starts map[int64]*blockListInfo) error {
+	//Reads the key arrays from start and builds out the keySpace. starts
+	//has the used blocks by where they start
+	kh := ks.kh
+	arraysize := int64(binary.Size(keyArrayHeader{})) + int64(binary.Size(keyEntry{}))*keyblocksize
+	visited := make(map[int64]bool)
+	for start != 0 {
+		block, ok := starts[start]
+		if !ok || block.Entry.Size != arraysize || visited[start] {
+			//A torn link to a list that was never used, drop it
+			if el := ks.keyHeaders.Back(); el != nil {
+				el.Value.(*keyArrayHeaderInfo).Header.Next = 0
+			}
+			return nil
+		}
+		visited[start] = true
 
-	entry := keyEntry{}
-	for i := int64(0); i < header.Size; i++ {
-		err := readFrom(kh.bli.file, start+offset, &entry)
+		header := keyArrayHeader{0, keyblocksize}
+		err := readFrom(kh.bli.file, start, &header)
 		if err != nil {
 			return err
 		}
 
-		if entry.Free > 0 {
-			//entry is free, append to free infos
-			info := keyInfo{start + offset, nil, nil}
-			kh.freeKeyInfos.PushBack(&info)
-		} else {
+		headerInfo := keyArrayHeaderInfo{&header, start, block}
+		ks.keyHeaders.PushBack(&headerInfo)
+		offset := int64(binary.Size(header))
+
+		entry := keyEntry{}
+		for i := int64(0); i < header.Size; i++ {
+			err := readFrom(kh.bli.file, start+offset, &entry)
+			if err != nil {
+				return err
+			}
+
+			info := keyInfo{Location: start + offset}
+			offset += int64(binary.Size(entry))
+			if entry.Free > 0 {
+				//entry is free, append to free infos
+				ks.freeKeyInfos.PushBack(&info)
+				continue
+			}
+			info.Seq = entry.Seq
+			if entry.Seq > kh.seq {
+				kh.seq = entry.Seq
+			}
+
+			if entry.Flags&flagInline != 0 {
+				if int(entry.Keylen)+int(entry.Datalen) > inlineSize {
+					return fmt.Errorf("keyhandler: readFile: Inline entry is %d bytes: %w", int(entry.Keylen)+int(entry.Datalen), ErrCorrupt)
+				}
+				key := string(entry.Inline[:entry.Keylen])
+				info.Inline = append([]byte(nil), entry.Inline[entry.Keylen:entry.Keylen+uint32(entry.Datalen)]...)
+				info.Flags = entry.Flags
+				err = ks.addRead(key, &info)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
 			//info has data, read it and set it in the key handler
 			keybli, ok := kh.bli.BlockListInfos[entry.Keyloc]
 			if !ok {
-				return errors.New("keyhandler: readFile: Location not found for key")
+				return fmt.Errorf("keyhandler: readFile: Location not found for key: %w", ErrCorrupt)
 			}
 			databli, ok := kh.bli.BlockListInfos[entry.Dataloc]
-			if !ok {
-				return errors.New("keyhandler: readFile: Location not found for data")
+			if !ok && entry.Flags&flagDeleted == 0 {
+				return fmt.Errorf("keyhandler: readFile: Location not found for data: %w", ErrCorrupt)
 			}
 
-			data, err := keybli.ReadData(kh.bli.file)
+			if entry.Flags&flagKeyEncrypted != 0 && kh.cipher == nil {
+				return ErrWrongKey
+			}
+			keyCipher, _ := kh.blockCiphers(entry.Flags)
+			data, err := keybli.ReadData(kh.bli.file, keyCipher)
 			if err != nil {
 				return err
 			}
+			if int64(len(*data)) != int64(entry.Keylen) {
+				return fmt.Errorf("keyhandler: readFile: Key is %d bytes, expected %d: %w", len(*data), entry.Keylen, ErrCorrupt)
+			}
 			key := string(*data)
 
 			//don't need to read the data since it's read during Get()
-			info := keyInfo{start + offset, keybli, databli}
-			kh.datalocs[key] = &info
-			offset += int64(binary.Size(entry))
+			info.Key = keybli
+			info.Data = databli
+			info.Flags = entry.Flags
+			err = ks.addRead(key, &info)
+			if err != nil {
+				return err
+			}
 		}
-	}
-	if header.Next > 0 {
-		return kh.readFile(header.Next)
+		start = header.Next
 	}
 	return nil
 }
 
-//Sets the key to data
-func (kh *KeyHandler) Set(key string, data []byte) error {
-	info, present := kh.datalocs[key]
-	if present {
-		return info.Update(kh.bli, key, data)
+func (ks *keySpace) addRead(key string, info *keyInfo) error {
+	//Adds an entry read from the file. The newest version is kept in
+	//datalocs even when it's a delete, see readHistory
+	kept, ok := ks.datalocs[key]
+	if !ok {
+		ks.datalocs[key] = info
+		return nil
+	}
+	if info.Seq > kept.Seq {
+		ks.datalocs[key] = info
+		info, kept = kept, info
 	}
+	if ks.history != nil && info.Seq < kept.Seq && kept.Flags&flagVersioned != 0 {
+		ks.history[key] = append(ks.history[key], info)
+		return nil
+	}
+	//a write failed after the new entry was written, but before the old
+	//one was freed
+	if ks.kh.readOnly {
+		return nil
+	}
+	return ks.release(info, kept)
+}
+
+func (ks *keySpace) release(info *keyInfo, kept *keyInfo) error {
+	//Frees the entry of a version that's no longer needed, without
+	//freeing the blocks it shares with kept, which can be nil. The entry
+	//is marked free before its blocks, so a write failing in between only
+	//leaks the blocks. Whatever replaced it is on the disk first
+	bli := ks.kh.bli
+	err := bli.barrier()
+	if err == nil {
+		err = info.freeEntry(bli)
+	}
+	if err == nil {
+		err = bli.barrier()
+	}
+	if err == nil && info.Data != nil && (kept == nil || info.Data != kept.Data) {
+		err = bli.SetFree(info.Data)
+	}
+	if err == nil && info.Key != nil && (kept == nil || info.Key != kept.Key) {
+		err = bli.SetFree(info.Key)
+	}
+	info.Key = nil
+	info.Data = nil
+	info.Inline = nil
+	ks.freeKeyInfos.PushBack(info)
+	return err
+}
 
-	el := kh.freeKeyInfos.Front()
+func (ks *keySpace) getFreeKeyInfo() (*keyInfo, error) {
+	//Takes a free key info, making a new list if there aren't any left
+	el := ks.freeKeyInfos.Front()
 
 	if el == nil {
-		err := kh.makeNewList()
+		err := ks.makeNewList()
 		if err != nil {
-			return err
+			return nil, err
 		}
-		el = kh.freeKeyInfos.Front()
+		el = ks.freeKeyInfos.Front()
 		if el == nil {
-			return errors.New("Unable to get a free key info after creating new")
+			return nil, errors.New("Unable to get a free key info after creating new")
 		}
 
 	}
 
 	info, ok := el.Value.(*keyInfo)
 	if !ok {
-		return errors.New("Invalid type in freeKeyInfos list")
+		return nil, errors.New("Invalid type in freeKeyInfos list")
+	}
+	ks.freeKeyInfos.Remove(el)
+	return info, nil
+}
+
+func (ks *keySpace) store(key string, size int64, flags uint8, rewriteKey bool, fill func(w io.WriterAt, info *keyInfo) error) error {
+	//Writes key into a new entry with a new data block filled by fill, then
+	//frees the old entry and data or keeps them as an earlier version.
+	//Nothing is overwritten in place, so whichever write fails the file
+	//still has the old or the new value
+	old := ks.datalocs[key]
+	//versions are freed one at a time, so they can't share a key block
+	if ks.versioned(key) {
+		rewriteKey = true
+		flags |= flagVersioned
+	}
+	seq := ks.kh.nextSeq()
+	if err := ks.kh.logChange(ks, key, OpSet, seq); err != nil {
+		return err
+	}
+	info, err := ks.writeVersion(key, old, seq, size, flags, rewriteKey, fill)
+	if err != nil {
+		ks.kh.unlogChange(ks, seq)
+		return err
+	}
+	ks.datalocs[key] = info
+	ks.kh.notify(ks, key, OpSet)
+	if old == nil {
+		return nil
 	}
-	kh.freeKeyInfos.Remove(el)
-	err := info.Update(kh.bli, key, data)
+	return ks.retire(key, old, info)
+}
+
+func (ks *keySpace) writeVersion(key string, old *keyInfo, seq int64, size int64, flags uint8, rewriteKey bool, fill func(w io.WriterAt, info *keyInfo) error) (*keyInfo, error) {
+	//Writes a new entry for key and returns it, leaving old as it is. The
+	//key block of old is shared unless rewriteKey is set. With flagInline
+	//there are no blocks and fill sets info.Inline, with flagDeleted
+	//there's no data block and fill is nil. fill returns a sourceError
+	//when what it reads from fails, so the new blocks can be freed
+	bli := ks.kh.bli
+	info, err := ks.getFreeKeyInfo()
 	if err != nil {
+		return nil, err
+	}
+
+	inline := flags&flagInline != 0
+	shareKey := old != nil && old.Key != nil && !inline && !rewriteKey
+	if shareKey {
+		info.Key = old.Key
+		flags = flags&^flagKeyEncrypted | old.Flags&flagKeyEncrypted
+	} else if !inline {
+		keyCipher, _ := ks.kh.blockCiphers(flags)
+		info.Key, err = bli.GetFree(sealedSize(keyCipher, int64(len(key))))
+		if err == nil {
+			err = info.Key.WriteData(bli.file, keyCipher, []byte(key))
+		}
+	}
+	if err == nil && flags&(flagInline|flagDeleted) == 0 {
+		info.Data, err = bli.GetFree(size)
+	}
+	if err == nil {
+		info.Flags = flags
+		info.Seq = seq
+		if fill != nil {
+			err = fill(bli.file, info)
+		}
+	}
+	if err == nil {
+		err = info.writeEntry(bli, key)
+	}
+	var source *sourceError
+	if errors.As(err, &source) {
+		//Nothing failed to write, so nothing points at the new blocks
+		err = source.err
+		if info.Key != nil && !shareKey {
+			bli.SetFree(info.Key)
+		}
+		if info.Data != nil {
+			bli.SetFree(info.Data)
+		}
+	}
+	if err != nil {
+		//Otherwise it's unknown how much made it to the file, so the
+		//blocks are leaked rather than freed
+		info.Key = nil
+		info.Data = nil
+		info.Inline = nil
+		ks.freeKeyInfos.PushFront(info)
+		return nil, err
+	}
+	return info, nil
+}
+
+func (ks *keySpace) free() error {
+	//Frees every block of the keySpace, the data and key blocks and the
+	//key arrays. Nothing else can point at them anymore, so the entries
+	//aren't marked free first
+	bli := ks.kh.bli
+	if err := ks.kh.saveSeq(); err != nil {
 		return err
 	}
-	kh.datalocs[key] = info
+	for _, info := range ks.datalocs {
+		if info.Flags&flagInline != 0 {
+			continue
+		}
+		if err := bli.SetFree(info.Key); err != nil {
+			return err
+		}
+		if err := bli.SetFree(info.Data); err != nil {
+			return err
+		}
+	}
+	for el := ks.keyHeaders.Front(); el != nil; el = el.Next() {
+		if err := bli.SetFree(el.Value.(*keyArrayHeaderInfo).Block); err != nil {
+			return err
+		}
+	}
+	ks.datalocs = make(map[string]*keyInfo)
+	ks.keyHeaders.Init()
+	ks.freeKeyInfos.Init()
 	return nil
 }
 
-//Gets the data contained at string
-//Returns nil if the key doesn't exist
-func (kh *KeyHandler) Get(key string) (*[]byte, error) {
-	info, ok := kh.datalocs[key]
-	if !ok {
-		return nil, nil
+func (ks *keySpace) uncache(key string) {
+	if ks.kh.cache != nil {
+		ks.kh.cache.remove(ks.cacheID + key)
+	}
+}
+
+func (ks *keySpace) cached(key string) ([]byte, bool) {
+	if ks.kh.cache == nil {
+		return nil, false
+	}
+	return ks.kh.cache.get(ks.cacheID + key)
+}
+
+func (ks *keySpace) put(key string, data []byte, flags uint8, rewriteKey bool) error {
+	size, flags, fill := ks.kh.dataWriter(key, data, flags)
+	return ks.store(key, size, flags, rewriteKey, fill)
+}
+
+func (kh *KeyHandler) dataWriter(key string, data []byte, flags uint8) (int64, uint8, func(w io.WriterAt, info *keyInfo) error) {
+	//Returns the size, flags and fill for storing data as it is, sealing
+	//it if flags has flagEncrypted. Small enough keys and values go in
+	//the entry
+	if kh.inline(key, int64(len(data))) {
+		return 0, flags | flagInline, func(w io.WriterAt, info *keyInfo) error {
+			info.Inline = append([]byte(nil), data...)
+			return nil
+		}
+	}
+	flags &^= flagInline
+	_, dataCipher := kh.blockCiphers(flags)
+	size := sealedSize(dataCipher, int64(len(data)))
+	return size, flags, func(w io.WriterAt, info *keyInfo) error {
+		return info.Data.WriteData(w, dataCipher, data)
+	}
+}
+
+func (kh *KeyHandler) inline(key string, size int64) bool {
+	//Returns if a value of size can be stored inline with key. Inline
+	//entries aren't sealed, so there are none with encryption
+	return kh.cipher == nil && int64(len(key))+size <= inlineSize
+}
+
+func (kh *KeyHandler) decoded(info *keyInfo) bool {
+	//Returns if the data has to go through readValue rather than being
+	//read from the file as it is
+	return kh.cache != nil || info.Flags&(flagCompressed|flagEncrypted|flagInline) != 0
+}
+
+func (ks *keySpace) readValue(key string, info *keyInfo) ([]byte, error) {
+	//Reads the whole value, decrypts and decompresses it and adds it to
+	//the cache. Inline values are already in memory and aren't cached
+	kh := ks.kh
+	data, err := kh.decode(info)
+	if err != nil {
+		return nil, err
+	}
+	if kh.cache != nil && info.Flags&flagInline == 0 {
+		kh.cache.add(ks.cacheID+key, data)
+	}
+	return data, nil
+}
+
+func (kh *KeyHandler) decode(info *keyInfo) ([]byte, error) {
+	//Returns the value, decrypted and decompressed. It's the entry's own
+	//slice for an uncompressed inline value
+	data, err := kh.rawValue(info)
+	if err != nil || info.Flags&flagCompressed == 0 {
+		return data, err
+	}
+	return decompress(data)
+}
+
+func (kh *KeyHandler) decodeCopy(info *keyInfo) ([]byte, error) {
+	//Same as decode, but the slice is never the entry's own
+	data, err := kh.decode(info)
+	if err == nil && info.Flags&flagInline != 0 {
+		data = append([]byte{}, data...)
+	}
+	return data, err
+}
+
+func (kh *KeyHandler) rawValue(info *keyInfo) ([]byte, error) {
+	//Returns the stored data of a value, decrypted but not decompressed
+	if info.Flags&flagInline != 0 {
+		return info.Inline, nil
+	}
+	if info.Flags&flagEncrypted != 0 && kh.cipher == nil {
+		//sealed by a Rekey the file was opened without the key for
+		return nil, ErrWrongKey
+	}
+	_, dataCipher := kh.blockCiphers(info.Flags)
+	read, err := info.Data.ReadData(kh.bli, dataCipher)
+	if err != nil {
+		return nil, err
+	}
+	return *read, nil
+}
+
+func (ks *keySpace) set(key string, data []byte) error {
+	if err := ks.checkWrite(key); err != nil {
+		return err
+	}
+	ks.uncache(key)
+	data, flags, err := ks.kh.compress(data)
+	if err != nil {
+		return err
+	}
+	return ks.put(key, data, flags|ks.encryptFlags(), false)
+}
+
+func checkSize(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("keyhandler: SetFromReader: Invalid size %d", size)
+	}
+	return nil
+}
+
+func (ks *keySpace) setFromReader(key string, r io.Reader, size int64) error {
+	if err := ks.checkWrite(key); err != nil {
+		return err
+	}
+	if err := checkSize(size); err != nil {
+		return err
+	}
+	ks.uncache(key)
+	if ks.kh.cipher != nil || ks.kh.inline(key, size) {
+		//the whole value is sealed or stored inline at once
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		return ks.put(key, data, ks.encryptFlags(), false)
+	}
+	return ks.store(key, size, 0, false, func(w io.WriterAt, info *keyInfo) error {
+		ew := &errWriter{w: newSectionWriter(w, info.Data.Entry.Start)}
+		_, err := io.CopyN(ew, r, size)
+		if err != nil && ew.err == nil {
+			return &sourceError{err}
+		}
+		return err
+	})
+}
+
+//An error from the reader a value was being read from rather than from
+//the file, see writeVersion
+type sourceError struct {
+	err error
+}
+
+func (e *sourceError) Error() string {
+	return e.err.Error()
+}
+
+//Keeps the error of the writer it wraps
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) Write(p []byte) (int, error) {
+	n, err := ew.w.Write(p)
+	if err != nil {
+		ew.err = err
+	}
+	return n, err
+}
+
+func (ks *keySpace) get(key string) (data []byte, found bool, err error) {
+	info, err := ks.lookup(key)
+	if err == ErrNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if cached, ok := ks.cached(key); ok {
+		return append([]byte{}, cached...), true, nil
+	}
+	data, err = ks.readValue(key, info)
+	if err != nil || (ks.kh.cache == nil && info.Flags&flagInline == 0) {
+		return data, err == nil, err
+	}
+	//the cache or the entry keeps data, so hand out a copy
+	return append([]byte{}, data...), true, nil
+}
+
+func (ks *keySpace) getInto(key string, dst []byte) ([]byte, error) {
+	info, err := ks.lookup(key)
+	if err != nil {
+		return dst, err
+	}
+
+	if cached, ok := ks.cached(key); ok {
+		return append(grow(dst, len(cached)), cached...), nil
+	}
+	if ks.kh.decoded(info) {
+		data, err := ks.readValue(key, info)
+		if err != nil {
+			return dst, err
+		}
+		return append(grow(dst, len(data)), data...), nil
+	}
+
+	bl := info.Data
+	dst = grow(dst, int(bl.Entry.Size))
+	n := len(dst)
+	dst = dst[:n+int(bl.Entry.Size)]
+	_, err = ks.kh.bli.ReadAt(dst[n:], bl.Entry.Start)
+	return dst, err
+}
+
+var viewBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+func (ks *keySpace) view(key string, fn func(data []byte) error) error {
+	info, err := ks.lookup(key)
+	if err != nil {
+		return err
+	}
+
+	if cached, ok := ks.cached(key); ok {
+		return fn(cached)
+	}
+	if ks.kh.decoded(info) {
+		data, err := ks.readValue(key, info)
+		if err != nil {
+			return err
+		}
+		return fn(data)
 	}
 
+	bli := ks.kh.bli
 	bl := info.Data
-	data := make([]byte, bl.Entry.Size)
-	_, err := kh.bli.file.ReadAt(data, bl.Entry.Start)
-	return &data, err
+	if data, ok := bli.slice(bl.Entry.Start, bl.Entry.Size); ok {
+		return fn(data)
+	}
+
+	buf := viewBuffers.Get().(*[]byte)
+	defer viewBuffers.Put(buf)
+
+	data := grow((*buf)[:0], int(bl.Entry.Size))[:bl.Entry.Size]
+	*buf = data
+	_, err = bli.ReadAt(data, bl.Entry.Start)
+	if err != nil {
+		return err
+	}
+	return fn(data)
+}
+
+//Reads the data of a value for GetReader. The read lock is taken for
+//each read, since a write can remap the file while the reader is open,
+//and the key is checked to still have the version that was opened,
+//since once it doesn't its data block can be reused
+type valueReader struct {
+	ks   *keySpace
+	key  string
+	seq  int64
+	data *blockListInfo
 }
 
-//Deletes the key if it exists. (returns if it doesn't)
-func (kh *KeyHandler) Del(key string) error {
-	info, ok := kh.datalocs[key]
+func (vr *valueReader) ReadAt(p []byte, off int64) (int, error) {
+	kh := vr.ks.kh
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	info, err := vr.ks.lookup(vr.key)
+	switch {
+	case err == ErrNotFound:
+		return 0, ErrValueChanged
+	case err != nil:
+		return 0, err
+	case info.Seq != vr.seq || info.Data != vr.data:
+		return 0, ErrValueChanged
+	}
+	return kh.bli.ReadAt(p, off)
+}
+
+func (ks *keySpace) getReader(key string) (*io.SectionReader, error) {
+	info, err := ks.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Flags&(flagCompressed|flagEncrypted|flagInline) != 0 {
+		data, err := ks.readValue(key, info)
+		if err != nil {
+			return nil, err
+		}
+		return io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil
+	}
+
+	bl := info.Data
+	return io.NewSectionReader(&valueReader{ks, key, info.Seq, bl}, bl.Entry.Start, bl.Entry.Size), nil
+}
+
+func (ks *keySpace) del(key string) (existed bool, err error) {
+	if err = ks.checkWrite(key); err != nil {
+		return false, err
+	}
+	ks.uncache(key)
+	info, ok := ks.datalocs[key]
 	if !ok {
-		return nil
+		return false, nil
+	}
+
+	seq := ks.kh.nextSeq()
+	if err = ks.kh.logChange(ks, key, OpDel, seq); err != nil {
+		return true, err
+	}
+	delete(ks.datalocs, key)
+	if ks.versioned(key) {
+		err = ks.retireDeleted(key, info, seq)
+	} else if err = ks.kh.saveSeq(); err == nil {
+		//nothing is written for the delete, so its seq is only in the
+		//header
+		err = ks.release(info, nil)
+	}
+	if _, ok = ks.datalocs[key]; ok {
+		ks.kh.unlogChange(ks, seq)
+	} else {
+		//the delete went through, even if freeing what it left didn't
+		ks.kh.notify(ks, key, OpDel)
+	}
+	return true, err
+}
+
+func (ks *keySpace) keys() ([]string, error) {
+	//Returns the keys in order
+	switch {
+	case ks.kh.closed:
+		return nil, ErrClosed
+	case ks.dropped:
+		return nil, ErrBucketNotFound
+	}
+	keys := make([]string, 0, len(ks.datalocs))
+	for key := range ks.datalocs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (ks *keySpace) forEach(fn func(key string, data []byte) error) error {
+	keys, err := ks.keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = ks.view(key, func(data []byte) error {
+			return fn(key, data)
+		})
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+//Sets the key to data
+func (kh *KeyHandler) Set(key string, data []byte) error {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	return kh.indexed(key, data, false, func() error {
+		return kh.set(key, data)
+	})
+}
 
-	delete(kh.datalocs, key)
-	kh.freeKeyInfos.PushBack(info)
-	return info.Free(kh)
+//Sets the key to the next size bytes read from r, without buffering
+//the whole value in memory unless the database is encrypted or has
+//indexes. The value is never compressed
+func (kh *KeyHandler) SetFromReader(key string, r io.Reader, size int64) error {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if len(kh.indexRoot.children) == 0 {
+		return kh.setFromReader(key, r, size)
+	}
+	if err := checkSize(size); err != nil {
+		return err
+	}
+	//the indexes need the whole value
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	return kh.indexed(key, data, false, func() error {
+		return kh.setFromReader(key, bytes.NewReader(data), size)
+	})
+}
+
+//Gets the data contained at key. found is false if the key doesn't exist
+func (kh *KeyHandler) Get(key string) (data []byte, found bool, err error) {
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	return kh.get(key)
+}
+
+//Appends the data contained at key to dst and returns the extended
+//slice, so a caller can reuse the same buffer across calls.
+//Returns dst and ErrNotFound if the key doesn't exist
+func (kh *KeyHandler) GetInto(key string, dst []byte) ([]byte, error) {
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	return kh.getInto(key, dst)
+}
+
+//Calls fn with the data contained at key. The slice is only valid until
+//fn returns and must not be modified or kept; copy it if it's needed
+//afterwards. With Options.Mmap the slice points straight into the mapped
+//file. fn must not write to kh. Returns ErrNotFound without calling fn if
+//the key doesn't exist
+func (kh *KeyHandler) View(key string, fn func(data []byte) error) error {
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	return kh.view(key, fn)
+}
+
+//Returns a reader over the data contained at key without reading it
+//into memory, unless it's compressed or encrypted. The reader also
+//supports ReadAt for reading ranges. Reading from the file fails with
+//ErrValueChanged once the key is written to or deleted, since its
+//blocks can then be reused. Returns ErrNotFound if the key doesn't
+//exist
+func (kh *KeyHandler) GetReader(key string) (*io.SectionReader, error) {
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	return kh.getReader(key)
+}
+
+//Deletes the key if it exists. existed is false if it didn't
+func (kh *KeyHandler) Del(key string) (existed bool, err error) {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	err = kh.indexed(key, nil, true, func() error {
+		existed, err = kh.del(key)
+		return err
+	})
+	return existed, err
+}
+
+func bytesKey(key []byte) string {
+	//Returns key as a string without copying it, for looking keys up.
+	//The string must not be kept, since it changes along with key
+	return unsafe.String(unsafe.SliceData(key), len(key))
+}
+
+//Same as Set, with the key as bytes. Keys can have any bytes with
+//either one. A new key is copied, since it's kept in memory
+func (kh *KeyHandler) SetBytes(key []byte, data []byte) error {
+	return kh.Set(string(key), data)
+}
+
+//Same as Get, with the key as bytes. The key isn't copied
+func (kh *KeyHandler) GetBytes(key []byte) (data []byte, found bool, err error) {
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	return kh.get(bytesKey(key))
+}
+
+//Same as Del, with the key as bytes
+func (kh *KeyHandler) DelBytes(key []byte) (existed bool, err error) {
+	return kh.Del(string(key))
+}
+
+//Returns all the keys in order. Keys in buckets aren't included
+func (kh *KeyHandler) Keys() ([]string, error) {
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	return kh.keys()
+}
+
+//Calls fn with each key and its data in key order, stopping at the
+//first error fn returns. data is only valid until fn returns, as with
+//View, and fn must not write to kh. Keys in buckets aren't included
+func (kh *KeyHandler) ForEach(fn func(key string, data []byte) error) error {
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	return kh.forEach(fn)
 }
 
 //Closes the file returned by Open, can be deferred that way
 func (kh *KeyHandler) Close() error {
-	return kh.bli.file.Close()
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if kh.closed {
+		return ErrClosed
+	}
+	kh.closed = true
+	kh.stopWatchers(ErrClosed)
+	//blocks held for open snapshots would otherwise stay used
+	err := kh.bli.freeHeld()
+	if err != nil {
+		kh.bli.Close()
+		return err
+	}
+	return kh.bli.Close()
+}
+
+//Returns the hit and miss counters of the value cache. They're all
+//zero if Options.CacheSize isn't set
+func (kh *KeyHandler) CacheStats() CacheStats {
+	if kh.cache == nil {
+		return CacheStats{}
+	}
+	return kh.cache.stats()
 }
@@ -1,8 +1,13 @@
 package gokvlite
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -20,16 +25,16 @@ func TestOpen(t *testing.T) {
 		t.Fatalf("Error: ", err)
 	}
 
-	data, err := kh.Get("blah")
-	if data != nil || err != nil {
+	data, found, err := kh.Get("blah")
+	if data != nil || found || err != nil {
 		t.Fatalf("Expected nil returns")
 	}
 
-	data, err = kh.Get("Testing")
+	data, found, err = kh.Get("Testing")
 	if err != nil {
 		t.Fatalf("Error: ", err)
 	}
-	if string(*data) != "blah" {
+	if !found || string(data) != "blah" {
 		t.Fatalf("Didn't receive the same thing we set")
 	}
 	if err = kh.Close(); err != nil {
@@ -42,11 +47,11 @@ func TestOpen(t *testing.T) {
 	}
 	defer kh.Close()
 
-	data, err = kh.Get("Testing")
+	data, _, err = kh.Get("Testing")
 	if err != nil {
 		t.Fatalf("Error: ", err)
 	}
-	if string(*data) != "blah" {
+	if string(data) != "blah" {
 		t.Fatalf("Invalid data")
 	}
 }
@@ -69,16 +74,556 @@ func TestMultiple(t *testing.T) {
 	}
 	for i := 0; i <= keyblocksize+20; i++ {
 		key := makeUuid()
-		var data *[]byte
+		var data []byte
 		err := kh.Set(key, []byte(key))
 		if err != nil {
 			t.Fatalf("Error in setting key", err)
 		}
-		if data, err = kh.Get(key); err != nil {
+		if data, _, err = kh.Get(key); err != nil {
 			t.Fatalf("Error: ", err)
 		}
-		if string(*data) != key {
+		if string(data) != key {
 			t.Fatalf("Data not equal to set value")
 		}
 	}
 }
+
+func TestGetReader(t *testing.T) {
+	tempfile := "/tmp/gotest_reader"
+	os.Remove(tempfile)
+	kh, err := Open(tempfile)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer kh.Close()
+
+	value := strings.Repeat("0123456789", 1000)
+	err = kh.SetFromReader("Testing", strings.NewReader(value), int64(len(value)))
+	if err != nil {
+		t.Fatalf("Error in SetFromReader: %v", err)
+	}
+
+	r, err := kh.GetReader("Testing")
+	if err != nil {
+		t.Fatalf("Error in GetReader: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if string(data) != value {
+		t.Fatalf("Data read doesn't match data set")
+	}
+
+	//Range reads
+	buf := make([]byte, 5)
+	if _, err = r.ReadAt(buf, 9995); err != nil {
+		t.Fatalf("Error in ReadAt: %v", err)
+	}
+	if string(buf) != "56789" {
+		t.Fatalf("Incorrect range read: %s", buf)
+	}
+	if _, err = r.Seek(3, io.SeekStart); err != nil {
+		t.Fatalf("Error in Seek: %v", err)
+	}
+	if _, err = r.Read(buf); err != nil || string(buf) != "34567" {
+		t.Fatalf("Incorrect read after seek: %s %v", buf, err)
+	}
+
+	//Short readers are an error
+	err = kh.SetFromReader("Short", strings.NewReader("abc"), 10)
+	if err == nil {
+		t.Fatalf("Expected an error from a short reader")
+	}
+
+	if err = kh.SetFromReader("Negative", strings.NewReader("abc"), -1); err == nil {
+		t.Fatalf("Expected an error for a negative size")
+	}
+	if err = kh.SetFromReader(strings.Repeat("Negative", 10), strings.NewReader("abc"), -1); err == nil {
+		t.Fatalf("Expected an error for a negative size")
+	}
+	if _, found, _ := kh.Get("Negative"); found {
+		t.Fatalf("Key with a negative size was set")
+	}
+
+	r, err = kh.GetReader("Missing")
+	if r != nil || err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound")
+	}
+
+	//Readers stop once the key is written, since the block they read can
+	//be taken by another key
+	r, err = kh.GetReader("Testing")
+	if err != nil {
+		t.Fatalf("Error in GetReader: %v", err)
+	}
+	if err = kh.Set("Testing", []byte(strings.Repeat("x", 100))); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("Other", []byte(strings.Repeat("y", len(value)))); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = r.ReadAt(buf, 0); err != ErrValueChanged {
+		t.Fatalf("Expected ErrValueChanged: %v", err)
+	}
+	r, _ = kh.GetReader("Other")
+	kh.Del("Other")
+	if _, err = r.Read(buf); err != ErrValueChanged {
+		t.Fatalf("Expected ErrValueChanged after Del: %v", err)
+	}
+}
+
+func TestSetFromReaderShort(t *testing.T) {
+	//Readers that end early don't leave their blocks behind
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("upload", []byte("first")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	size, _ := ms.Size()
+	for i := 0; i < 20; i++ {
+		r := io.LimitReader(bytes.NewReader(make([]byte, 1<<20)), 1<<19)
+		if err = kh.SetFromReader("upload", r, 1<<20); err != io.EOF {
+			t.Fatalf("Expected io.EOF from the short reader: %v", err)
+		}
+	}
+	if grown, _ := ms.Size(); grown-size > 3<<19 {
+		t.Fatalf("File grew by %d bytes", grown-size)
+	}
+	if data, _, err := kh.Get("upload"); err != nil || string(data) != "first" {
+		t.Fatalf("Incorrect data after failed writes: %q %v", data, err)
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	tempfile := "/tmp/gotest_getinto"
+	os.Remove(tempfile)
+	kh, err := Open(tempfile)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer kh.Close()
+
+	if err = kh.Set("a", []byte("first")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("b", []byte("second")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("empty", []byte{}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	buf := make([]byte, 0, 64)
+	buf, err = kh.GetInto("a", buf)
+	if err != nil {
+		t.Fatalf("Error in GetInto: %v", err)
+	}
+	buf, err = kh.GetInto("b", buf)
+	if err != nil {
+		t.Fatalf("Error in GetInto: %v", err)
+	}
+	if string(buf) != "firstsecond" {
+		t.Fatalf("Incorrect data appended: %s", buf)
+	}
+	if cap(buf) != 64 {
+		t.Fatalf("GetInto reallocated a buffer that was large enough")
+	}
+
+	data, err := kh.GetInto("empty", nil)
+	if data == nil || len(data) != 0 || err != nil {
+		t.Fatalf("Expected an empty, non nil slice")
+	}
+	data, err = kh.GetInto("missing", buf[:0])
+	if len(data) != 0 || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound")
+	}
+}
+
+func TestView(t *testing.T) {
+	tempfile := "/tmp/gotest_view"
+	os.Remove(tempfile)
+	kh, err := Open(tempfile)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer kh.Close()
+
+	if err = kh.Set("Testing", []byte("blah")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	var seen string
+	err = kh.View("Testing", func(data []byte) error {
+		seen = string(data)
+		return nil
+	})
+	if err != nil || seen != "blah" {
+		t.Fatalf("Incorrect data in View: %s %v", seen, err)
+	}
+
+	err = kh.View("Testing", func(data []byte) error {
+		return io.EOF
+	})
+	if err != io.EOF {
+		t.Fatalf("Error from fn wasn't returned")
+	}
+
+	err = kh.View("missing", func(data []byte) error {
+		t.Fatalf("fn called for a missing key")
+		return nil
+	})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected ErrNotFound")
+	}
+}
+
+func TestDel(t *testing.T) {
+	tempfile := "/tmp/gotest_del"
+	os.Remove(tempfile)
+	kh, err := Open(tempfile)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer kh.Close()
+
+	if err = kh.Set("Testing", []byte("blah")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	existed, err := kh.Del("Testing")
+	if !existed || err != nil {
+		t.Fatalf("Expected key to exist: %v", err)
+	}
+	existed, err = kh.Del("Testing")
+	if existed || err != nil {
+		t.Fatalf("Expected key to not exist: %v", err)
+	}
+	if _, found, _ := kh.Get("Testing"); found {
+		t.Fatalf("Key found after delete")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tempfile := "/tmp/gotest_errors"
+	os.Remove(tempfile)
+
+	_, err := OpenWithOptions(tempfile, &Options{ReadOnly: true})
+	if !os.IsNotExist(err) {
+		t.Fatalf("Read only open shouldn't create the file: %v", err)
+	}
+
+	kh, err := Open(tempfile)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	err = kh.Set(strings.Repeat("k", maxKeySize+1), []byte("blah"))
+	if !errors.Is(err, ErrKeyTooLarge) {
+		t.Fatalf("Expected ErrKeyTooLarge: %v", err)
+	}
+	if err = kh.Set("Testing", []byte("blah")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Close(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, _, err = kh.Get("Testing"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected ErrClosed: %v", err)
+	}
+	if err = kh.Set("Testing", nil); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected ErrClosed: %v", err)
+	}
+	if err = kh.Close(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected ErrClosed: %v", err)
+	}
+
+	kh, err = OpenWithOptions(tempfile, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer kh.Close()
+	if data, _, err := kh.Get("Testing"); err != nil || string(data) != "blah" {
+		t.Fatalf("Incorrect data in read only mode: %v", err)
+	}
+	if err = kh.Set("Testing", nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly: %v", err)
+	}
+	if _, err = kh.Del("Testing"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly: %v", err)
+	}
+}
+
+func TestMmap(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap isn't supported on this platform")
+	}
+	tempfile := "/tmp/gotest_mmap"
+	os.Remove(tempfile)
+	kh, err := OpenWithOptions(tempfile, &Options{Mmap: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("Testing", []byte("blah")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Close(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	kh, err = OpenWithOptions(tempfile, &Options{Mmap: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer kh.Close()
+	mapped := len(kh.bli.mapped)
+	if mapped == 0 {
+		t.Fatalf("File wasn't mapped")
+	}
+
+	//Values written after opening grow the mapping
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err = kh.Set(key, []byte(strings.Repeat(key, 100))); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if len(kh.bli.mapped) <= mapped {
+		t.Fatalf("Mapping wasn't grown")
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		err = kh.View(key, func(data []byte) error {
+			if string(data) != strings.Repeat(key, 100) {
+				t.Fatalf("Incorrect data in View for %s", key)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	//Readers can be read while writes grow the mapping
+	r, err := kh.GetReader("key0")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 100; i++ {
+			data, err := ioutil.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+			if err == nil && string(data) != strings.Repeat("key0", 100) {
+				err = fmt.Errorf("incorrect data from GetReader: %s", data)
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 100; i < 200; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err = kh.Set(key, []byte(strings.Repeat(key, 100))); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//Overwriting in place is visible through the mapping
+	if err = kh.Set("Testing", []byte("halb")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if data, _, err := kh.Get("Testing"); err != nil || string(data) != "halb" {
+		t.Fatalf("Incorrect data after overwrite: %s %v", data, err)
+	}
+}
+
+func TestReopenAfterDel(t *testing.T) {
+	//Freed blocks and entries are reused after reopening
+	tempfile := "/tmp/gotest_reopen"
+	os.Remove(tempfile)
+	kh, err := Open(tempfile)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err = kh.Set(key, []byte(strings.Repeat(key, 10))); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	for i := 0; i < 10; i += 2 {
+		if _, err = kh.Del(fmt.Sprintf("key%d", i)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	kh.Close()
+
+	kh, err = Open(tempfile)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if kh.bli.Freeblocks.Len() == 0 {
+		t.Fatalf("Free blocks weren't read back")
+	}
+	size, _ := kh.bli.file.Size()
+	for i := 0; i < 10; i += 2 {
+		key := fmt.Sprintf("new%d", i)
+		if err = kh.Set(key, []byte(key)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if newsize, _ := kh.bli.file.Size(); newsize != size {
+		t.Fatalf("Free blocks weren't reused, file grew from %d to %d", size, newsize)
+	}
+	kh.Close()
+
+	kh, err = Open(tempfile)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer kh.Close()
+	for i := 0; i < 10; i++ {
+		key, value := fmt.Sprintf("key%d", i), ""
+		if i%2 == 0 {
+			key = fmt.Sprintf("new%d", i)
+			value = key
+		} else {
+			value = strings.Repeat(key, 10)
+		}
+		data, found, err := kh.Get(key)
+		if err != nil || !found || string(data) != value {
+			t.Fatalf("Incorrect data for %s: %s %v", key, data, err)
+		}
+	}
+}
+
+func TestBinaryKeys(t *testing.T) {
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, &Options{MaxKeySize: 100000})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	keys := [][]byte{{0}, {0, 0}, {0xff, 0xfe, 0}, []byte(""), bytes.Repeat([]byte{1}, 70000)}
+	for i, key := range keys {
+		if err = kh.SetBytes(key, []byte{byte(i)}); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i, key := range keys {
+		data, found, err := kh.GetBytes(key)
+		if err != nil || !found || len(data) != 1 || data[0] != byte(i) {
+			t.Fatalf("Incorrect data for key %d: %v %v %v", i, data, found, err)
+		}
+	}
+	if existed, err := kh.DelBytes(keys[1]); !existed || err != nil {
+		t.Fatalf("Key wasn't deleted: %v", err)
+	}
+	if _, found, _ := kh.GetBytes(keys[1]); found {
+		t.Fatalf("Key found after Del")
+	}
+
+	//the limit is only checked when writing
+	err = kh.SetBytes(keys[4], nil)
+	var tooLarge *KeyTooLargeError
+	if !errors.Is(err, ErrKeyTooLarge) || !errors.As(err, &tooLarge) {
+		t.Fatalf("Expected a KeyTooLargeError: %v", err)
+	}
+	if tooLarge.Size != 70000 || tooLarge.MaxSize != maxKeySize {
+		t.Fatalf("Incorrect sizes: %+v", tooLarge)
+	}
+	kh, err = OpenStorage(ms, &Options{MaxKeySize: 2})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("abc", nil); !errors.As(err, &tooLarge) || tooLarge.MaxSize != 2 {
+		t.Fatalf("Expected a KeyTooLargeError: %v", err)
+	}
+}
+
+func TestInline(t *testing.T) {
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	blocks := len(kh.bli.BlockListInfos)
+	if err = kh.Set("counter", []byte("secret-1")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.SetFromReader("flag", strings.NewReader("on"), 2); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, key := range []string{"counter", "flag"} {
+		if info := kh.datalocs[key]; info.Flags&flagInline == 0 || info.Key != nil || info.Data != nil {
+			t.Fatalf("%s wasn't stored inline", key)
+		}
+	}
+	if len(kh.bli.BlockListInfos) != blocks {
+		t.Fatalf("Inline values took blocks")
+	}
+
+	//values move in and out of the entry as they grow and shrink
+	large := strings.Repeat("x", inlineSize)
+	if err = kh.Set("counter", []byte(large)); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if kh.datalocs["counter"].Flags&flagInline != 0 {
+		t.Fatalf("Large value was stored inline")
+	}
+	if bytes.Contains(ms.data, []byte("secret-1")) {
+		t.Fatalf("Old inline value left in the file")
+	}
+	if err = kh.Set("counter", []byte("2")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, _, _ := kh.Get("counter")
+	data[0] = '3'
+
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for key, value := range map[string]string{"counter": "2", "flag": "on"} {
+		data, found, err := kh.Get(key)
+		if err != nil || !found || string(data) != value {
+			t.Fatalf("Incorrect data for %s: %s %v", key, data, err)
+		}
+		r, err := kh.GetReader(key)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if data, _ = ioutil.ReadAll(r); string(data) != value {
+			t.Fatalf("Incorrect data from GetReader for %s: %s", key, data)
+		}
+	}
+	if existed, err := kh.Del("flag"); !existed || err != nil {
+		t.Fatalf("Key wasn't deleted: %v", err)
+	}
+	if bytes.Contains(ms.data, []byte("flag")) {
+		t.Fatalf("Deleted inline entry left in the file")
+	}
+
+	//inline entries aren't sealed
+	kh, err = OpenStorage(NewMemStorage(), &Options{EncryptionKey: testKey})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("small", []byte("1")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if kh.datalocs["small"].Flags&flagInline != 0 {
+		t.Fatalf("Value was stored inline with encryption")
+	}
+}
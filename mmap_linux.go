@@ -0,0 +1,20 @@
+//go:build linux
+
+package gokvlite
+
+import (
+	"os"
+	"syscall"
+)
+
+const mmapSupported = true
+
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	//Maps the first size bytes of file read only. Writes through the
+	//file are visible in the mapping since it's shared
+	return syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package gokvlite
+
+import (
+	"errors"
+	"os"
+)
+
+const mmapSupported = false
+
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("gokvlite: mmap is not supported on this platform")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
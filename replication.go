@@ -0,0 +1,313 @@
+package gokvlite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+//A follower starts the connection with this header, and the primary
+//answers with messages that each start with one of the message types
+//below. Seqs are written as uvarints, and strings and values as with
+//incremental backups
+type replicaHeader struct {
+	Magic   [8]byte
+	Version uint32
+	//the last write the follower has from the primary, or -1 for none
+	Since int64
+}
+
+var replicaMagic = [8]byte{'g', 'k', 'v', 'l', 'r', 'e', 'p', 'l'}
+
+const replicaVersion = 1
+
+const (
+	//the keys up to msgSynced are a copy of every key of the primary,
+	//and the follower's other keys are deleted
+	msgResync uint8 = iota + 1
+	//the end of a resync, with the seq of the snapshot it was from
+	msgSynced
+	//a seq, a key and its value
+	msgSet
+	//a seq and a deleted key
+	msgDel
+)
+
+//The bucket of a follower under changeLogParent. Its empty key holds the
+//last seq it has from the primary, which is -1 while it's resyncing
+const replicaName = "replica"
+
+//Sends the writes to the keys of kh to a follower on conn, see Follow,
+//until the follower hangs up or kh is closed. The follower is first
+//caught up from the seq it has with the change log, so kh needs
+//Options.ChangeLog. If the changes it's missing aren't in the log
+//anymore, it gets a copy of every key from a Snapshot instead. The
+//value sent for a Set is the one the key has when it's sent, so a
+//follower can be ahead on some keys until the writes in between reach
+//it. Keys in buckets aren't replicated. conn isn't closed
+func (kh *KeyHandler) ServeReplica(conn net.Conn) error {
+	var header replicaHeader
+	if err := binary.Read(conn, binary.LittleEndian, &header); err != nil {
+		return err
+	}
+	if header.Magic != replicaMagic || header.Version != replicaVersion {
+		return fmt.Errorf("replication: not a follower: %w", ErrCorrupt)
+	}
+
+	//The watcher is made before the log is read, so no write is missed
+	//while waiting for the next one
+	w, err := kh.Watch("")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		w.Close()
+	}()
+	done := make(chan struct{})
+	go func() {
+		//followers don't send anything after the header, so this
+		//returns once they hang up
+		io.Copy(io.Discard, conn)
+		close(done)
+	}()
+
+	bw := bufio.NewWriter(conn)
+	it, err := kh.ChangesSince(header.Since)
+	if err == nil && header.Since > kh.Seq() {
+		//it followed another primary, or this one before a restore
+		err = ErrChangesTrimmed
+	}
+	for {
+		if err == ErrChangesTrimmed {
+			it, err = kh.resync(bw)
+		}
+		if err != nil {
+			return err
+		}
+		for it.Next() {
+			if err = kh.sendChange(bw, it.Event()); err != nil {
+				return err
+			}
+		}
+		if err = it.Err(); err != nil {
+			continue
+		}
+		if err = bw.Flush(); err != nil {
+			return err
+		}
+
+		select {
+		case <-done:
+			return nil
+		case _, ok := <-w.Events():
+			if ok {
+				continue
+			}
+			if w.Err() != ErrWatchOverflow {
+				return w.Err()
+			}
+			//the log has the writes it missed
+			if w, err = kh.Watch(""); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (kh *KeyHandler) resync(w *bufio.Writer) (*ChangeIterator, error) {
+	//Sends every key from a snapshot, and returns an iterator over the
+	//changes made since
+	s, err := kh.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer s.Release()
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	w.WriteByte(msgResync)
+	for _, key := range keys {
+		//one at a time, so writes to kh don't wait for the whole copy
+		data, _, err := s.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		w.WriteByte(msgSet)
+		writeUvarint(w, uint64(s.Seq()))
+		writeString(w, key)
+		writeString(w, string(data))
+	}
+	w.WriteByte(msgSynced)
+	writeUvarint(w, uint64(s.Seq()))
+	return kh.ChangesSince(s.Seq())
+}
+
+func (kh *KeyHandler) sendChange(w *bufio.Writer, event Event) error {
+	if event.Op == OpDel {
+		w.WriteByte(msgDel)
+		writeUvarint(w, uint64(event.Seq))
+		writeString(w, event.Key)
+		return nil
+	}
+	data, found, err := kh.Get(event.Key)
+	if err != nil || !found {
+		//deleted since, which is a later change
+		return err
+	}
+	w.WriteByte(msgSet)
+	writeUvarint(w, uint64(event.Seq))
+	writeString(w, event.Key)
+	writeString(w, string(data))
+	return nil
+}
+
+//Applies the writes a primary sends on conn with ServeReplica to kh,
+//which has to be opened with Options.Follower, until conn is closed or
+//fails. kh keeps the seq of the last write it has from the primary, so
+//calling Follow again with a new connection picks up from there. Reads
+//can go on while Follow runs, but a resync changes the keys one at a
+//time, so reads during one can see some keys from before it. conn isn't
+//closed
+func (kh *KeyHandler) Follow(conn net.Conn) error {
+	if !kh.follower {
+		return ErrNotFollower
+	}
+	since, err := kh.replicaSeq()
+	if err != nil {
+		return err
+	}
+	header := replicaHeader{replicaMagic, replicaVersion, since}
+	if err = binary.Write(conn, binary.LittleEndian, header); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	//the keys sent by the resync going on, if there is one
+	var synced map[string]bool
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case msgResync:
+			synced = make(map[string]bool)
+			err = kh.apply(func() error {
+				//if the resync is cut off, the next one starts over
+				return kh.setReplicaSeq(-1)
+			})
+		case msgSynced:
+			var seq uint64
+			if seq, err = binary.ReadUvarint(r); err != nil {
+				return err
+			}
+			if synced == nil {
+				return fmt.Errorf("replication: end of a resync that wasn't started: %w", ErrCorrupt)
+			}
+			err = kh.apply(func() error {
+				if err := kh.deleteUnsynced(synced); err != nil {
+					return err
+				}
+				return kh.setReplicaSeq(int64(seq))
+			})
+			synced = nil
+		case msgSet, msgDel:
+			err = kh.applyChange(r, op, synced)
+		default:
+			return fmt.Errorf("replication: unknown message %d: %w", op, ErrCorrupt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (kh *KeyHandler) applyChange(r *bufio.Reader, op uint8, synced map[string]bool) error {
+	//Reads a msgSet or msgDel and applies it. The seq is kept unless
+	//it's part of a resync
+	seq, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	key, err := readString(r)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if op == msgSet {
+		value, err := readString(r)
+		if err != nil {
+			return err
+		}
+		data = []byte(value)
+	}
+	if synced != nil {
+		synced[key] = true
+	}
+	return kh.apply(func() error {
+		err := kh.indexed(key, data, op == msgDel, func() error {
+			if op == msgDel {
+				_, err := kh.del(key)
+				return err
+			}
+			return kh.set(key, data)
+		})
+		if err != nil || synced != nil {
+			return err
+		}
+		return kh.setReplicaSeq(int64(seq))
+	})
+}
+
+func (kh *KeyHandler) apply(fn func() error) error {
+	//Runs fn with the writes of a follower allowed
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if kh.closed {
+		return ErrClosed
+	}
+	kh.applying = true
+	defer func() {
+		kh.applying = false
+	}()
+	return fn()
+}
+
+func (kh *KeyHandler) deleteUnsynced(synced map[string]bool) error {
+	//Deletes the keys a resync didn't send
+	keys, err := kh.keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if synced[key] {
+			continue
+		}
+		err = kh.indexed(key, nil, true, func() error {
+			_, err := kh.del(key)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (kh *KeyHandler) replicaSeq() (int64, error) {
+	//Returns the last seq the follower has from the primary
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	if kh.closed {
+		return 0, ErrClosed
+	}
+	seq, _, err := kh.storedSeq(replicaName)
+	return seq, err
+}
+
+func (kh *KeyHandler) setReplicaSeq(seq int64) error {
+	return kh.setStoredSeq(replicaName, seq)
+}
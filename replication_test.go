@@ -0,0 +1,141 @@
+package gokvlite
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func waitSynced(t *testing.T, primary *KeyHandler, follower *KeyHandler) {
+	//Waits until the follower has the same keys and values as the primary
+	want := dumpKeys(t, primary)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := dumpKeys(t, follower)
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Follower has %s, expected %s", got, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func dumpKeys(t *testing.T, kh *KeyHandler) string {
+	var dump []string
+	err := kh.ForEach(func(key string, data []byte) error {
+		dump = append(dump, key+"="+string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	return fmt.Sprint(dump)
+}
+
+func connectFollower(t *testing.T, l net.Listener, primary *KeyHandler, follower *KeyHandler) (net.Conn, chan error) {
+	//Connects the follower to the primary over l, returning the
+	//follower's end and where Follow's error goes
+	served := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			served <- nil
+			return
+		}
+		served <- conn
+		primary.ServeReplica(conn)
+		conn.Close()
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if <-served == nil {
+		t.Fatalf("Accept failed")
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- follower.Follow(conn)
+	}()
+	return conn, done
+}
+
+func TestReplication(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer l.Close()
+	primary, err := OpenStorage(NewMemStorage(), &Options{ChangeLog: true, ChangeLogCount: 4})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer primary.Close()
+	ms := NewMemStorage()
+	follower, err := OpenStorage(ms, &Options{Follower: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err = primary.Set(fmt.Sprint("before-", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	//a new follower gets a full copy, then the writes as they're made
+	conn, done := connectFollower(t, l, primary, follower)
+	waitSynced(t, primary, follower)
+	if err = primary.Set("live", []byte("value")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = primary.Del("before-0"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	waitSynced(t, primary, follower)
+	if err = follower.Set("key", []byte("value")); err != ErrReadOnly {
+		t.Fatalf("Incorrect error writing to a follower: %v", err)
+	}
+	conn.Close()
+	<-done
+
+	//reconnecting catches up with the changes in the log, also after
+	//reopening the follower
+	if err = primary.Set("before-1", []byte("changed")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = primary.Del("live"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if follower, err = OpenStorage(ms, &Options{Follower: true}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	conn, done = connectFollower(t, l, primary, follower)
+	waitSynced(t, primary, follower)
+	conn.Close()
+	<-done
+
+	//once the log no longer has what it missed, it's resynced, which
+	//drops the keys the primary deleted
+	if _, err = primary.Del("before-2"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err = primary.Set(fmt.Sprint("after-", i), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if _, err = primary.ChangesSince(primary.Seq() - 6); err != ErrChangesTrimmed {
+		t.Fatalf("Changes weren't trimmed: %v", err)
+	}
+	conn, done = connectFollower(t, l, primary, follower)
+	waitSynced(t, primary, follower)
+	conn.Close()
+	<-done
+
+	if err = primary.Follow(conn); err != ErrNotFollower {
+		t.Fatalf("Incorrect error following with a primary: %v", err)
+	}
+}
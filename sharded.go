@@ -0,0 +1,202 @@
+package gokvlite
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//A ShardedStore spreads keys over several database files by a hash of
+//the key, so that each file keeps fewer keys in memory and writes to
+//different files don't wait for each other. The files are named after
+//the path of the store, the shard number and the number of shards, see
+//OpenSharded. It has the same methods as KeyHandler for reading and
+//writing keys, so it can be used as a Store. Keys and ForEach merge the
+//shards in key order
+type ShardedStore struct {
+	shards []*KeyHandler
+}
+
+func shardPath(path string, i int, n int) string {
+	return fmt.Sprintf("%s.%d-of-%d", path, i, n)
+}
+
+func shardCounts(path string) (map[int]bool, error) {
+	//Returns the numbers of shards there are files for at path
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	counts := make(map[int]bool)
+	for _, entry := range entries {
+		name, ok := strings.CutPrefix(entry.Name(), base+".")
+		if !ok {
+			continue
+		}
+		var i, n int
+		if _, err = fmt.Sscanf(name, "%d-of-%d", &i, &n); err == nil && shardPath(base, i, n) == entry.Name() {
+			counts[n] = true
+		}
+	}
+	return counts, nil
+}
+
+func openShards(path string, n int, opts *Options) (*ShardedStore, error) {
+	s := &ShardedStore{shards: make([]*KeyHandler, 0, n)}
+	for i := 0; i < n; i++ {
+		kh, err := OpenWithOptions(shardPath(path, i, n), opts)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.shards = append(s.shards, kh)
+	}
+	return s, nil
+}
+
+//Opens a ShardedStore with n shards at path, in the files path.0-of-n
+//to path.(n-1)-of-n, which are created if they don't exist. Each one is
+//opened with opts. Returns ErrShardCount if there are shards at path
+//for another number of shards, see Reshard
+func OpenSharded(path string, n int, opts *Options) (*ShardedStore, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("sharded: OpenSharded: Invalid shard count %d", n)
+	}
+	counts, err := shardCounts(path)
+	if err != nil {
+		return nil, err
+	}
+	delete(counts, n)
+	if len(counts) != 0 {
+		return nil, ErrShardCount
+	}
+	return openShards(path, n, opts)
+}
+
+func (s *ShardedStore) shard(key string) *KeyHandler {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return s.shards[h.Sum64()%uint64(len(s.shards))]
+}
+
+//Sets the key to data in its shard
+func (s *ShardedStore) Set(key string, data []byte) error {
+	return s.shard(key).Set(key, data)
+}
+
+//Gets the data contained at key. found is false if the key doesn't exist
+func (s *ShardedStore) Get(key string) (data []byte, found bool, err error) {
+	return s.shard(key).Get(key)
+}
+
+//Calls fn with the data contained at key, as with KeyHandler.View
+func (s *ShardedStore) View(key string, fn func(data []byte) error) error {
+	return s.shard(key).View(key, fn)
+}
+
+//Deletes the key if it exists. existed is false if it didn't
+func (s *ShardedStore) Del(key string) (existed bool, err error) {
+	return s.shard(key).Del(key)
+}
+
+//Returns the keys of every shard in order
+func (s *ShardedStore) Keys() ([]string, error) {
+	var keys []string
+	for _, kh := range s.shards {
+		shardKeys, err := kh.Keys()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, shardKeys...)
+	}
+	//a key is only ever in one shard
+	sort.Strings(keys)
+	return keys, nil
+}
+
+//Calls fn with each key of every shard and its data in key order,
+//stopping at the first error fn returns. data is only valid until fn
+//returns, as with View. Each value is read on its own, so writes can go
+//on in the meantime: a key deleted before fn gets to it is left out
+func (s *ShardedStore) ForEach(fn func(key string, data []byte) error) error {
+	keys, err := s.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = s.View(key, func(data []byte) error {
+			return fn(key, data)
+		})
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+//Returns the KeyHandlers of the shards, for what ShardedStore doesn't
+//have. Keys written to them directly have to go to the shard Set would
+//pick
+func (s *ShardedStore) Shards() []*KeyHandler {
+	return s.shards
+}
+
+//Closes every shard, returning the first error
+func (s *ShardedStore) Close() error {
+	var first error
+	for _, kh := range s.shards {
+		if err := kh.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+//Moves the keys of the ShardedStore at path from shards for from to
+//shards for to, and removes the old files. The store must not be open
+//while it runs. The new files are written and synced before the old ones
+//are removed, so if it's interrupted, running it again finishes it
+func Reshard(path string, from int, to int, opts *Options) error {
+	if to < 1 || from < 1 {
+		return fmt.Errorf("sharded: Reshard: Invalid shard count %d to %d", from, to)
+	}
+	if from == to {
+		return nil
+	}
+	src, err := openShards(path, from, opts)
+	if err != nil {
+		return err
+	}
+	dst, err := openShards(path, to, opts)
+	if err != nil {
+		src.Close()
+		return err
+	}
+	err = src.ForEach(dst.Set)
+	for _, kh := range dst.shards {
+		if err == nil {
+			err = kh.bli.file.Sync()
+		}
+	}
+	src.Close()
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	for i := 0; i < from; i++ {
+		if err = os.Remove(shardPath(path, i, from)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package gokvlite
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func checkSharded(t *testing.T, s *ShardedStore, n int) {
+	var keys []string
+	err := s.ForEach(func(key string, data []byte) error {
+		if string(data) != "value-"+key {
+			t.Fatalf("Incorrect data for %s: %s", key, data)
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(keys) != n {
+		t.Fatalf("Found %d keys, expected %d", len(keys), n)
+	}
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] {
+			t.Fatalf("Keys out of order: %v", keys)
+		}
+	}
+}
+
+func TestSharded(t *testing.T) {
+	dir, err := os.MkdirTemp("", "gotest_sharded")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store")
+
+	s, err := OpenSharded(path, 3, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("key-", i)
+		if err = s.Set(key, []byte("value-"+key)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if existed, err := s.Del("key-0"); err != nil || !existed {
+		t.Fatalf("Error deleting: %v %v", existed, err)
+	}
+	if _, found, _ := s.Get("key-0"); found {
+		t.Fatalf("Deleted key found")
+	}
+	checkSharded(t, s, 99)
+	for i, kh := range s.Shards() {
+		if keys, _ := kh.Keys(); len(keys) == 0 || len(keys) == 99 {
+			t.Fatalf("Shard %d has %d keys", i, len(keys))
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if err = Reshard(path, 3, 5, nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = OpenSharded(path, 3, nil); err != ErrShardCount {
+		t.Fatalf("Incorrect error opening with the old count: %v", err)
+	}
+	s, err = OpenSharded(path, 5, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer s.Close()
+	checkSharded(t, s, 99)
+	if _, err = os.Stat(shardPath(path, 0, 3)); !os.IsNotExist(err) {
+		t.Fatalf("Old shard left behind: %v", err)
+	}
+}
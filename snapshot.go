@@ -0,0 +1,202 @@
+package gokvlite
+
+import (
+	"sort"
+)
+
+//A Snapshot is a read only view of the keys of a KeyHandler as they were
+//when it was made. Writes to the KeyHandler after that don't change it,
+//and the blocks they free aren't reused until every open snapshot is
+//released, so the file grows faster while one is open. If the database
+//isn't closed, the blocks are freed the next time it's opened. Keys in
+//buckets aren't included
+type Snapshot struct {
+	kh *KeyHandler
+	//copies of the entries, since the KeyHandler reuses its own
+	datalocs map[string]keyInfo
+	seq      int64
+	released bool
+}
+
+//Returns a Snapshot of the keys of kh. It has to be released with
+//Release once it's no longer needed
+func (kh *KeyHandler) Snapshot() (*Snapshot, error) {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if kh.closed {
+		return nil, ErrClosed
+	}
+	s := &Snapshot{kh: kh, datalocs: make(map[string]keyInfo, len(kh.datalocs)), seq: kh.seq}
+	for key, info := range kh.datalocs {
+		s.datalocs[key] = *info
+	}
+	kh.bli.snapshots++
+	return s, nil
+}
+
+//Returns the seq of the last write the snapshot has
+func (s *Snapshot) Seq() int64 {
+	return s.seq
+}
+
+func (s *Snapshot) checkRead() error {
+	if s.released || s.kh.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+//Returns the data key had when the snapshot was made, and if it existed
+func (s *Snapshot) Get(key string) (data []byte, found bool, err error) {
+	s.kh.lock.RLock()
+	defer s.kh.lock.RUnlock()
+	if err = s.checkRead(); err != nil {
+		return nil, false, err
+	}
+	info, ok := s.datalocs[key]
+	if !ok {
+		return nil, false, nil
+	}
+	data, err = s.kh.decodeCopy(&info)
+	return data, err == nil, err
+}
+
+//Returns the keys of the snapshot in order
+func (s *Snapshot) Keys() ([]string, error) {
+	s.kh.lock.RLock()
+	defer s.kh.lock.RUnlock()
+	return s.keys()
+}
+
+func (s *Snapshot) keys() ([]string, error) {
+	if err := s.checkRead(); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(s.datalocs))
+	for key := range s.datalocs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+//Calls fn with each key of the snapshot and its data in key order,
+//stopping at the first error fn returns. data is only valid until fn
+//returns and must not be modified. Writes to the KeyHandler wait until
+//ForEach is done, so fn must not write to it
+func (s *Snapshot) ForEach(fn func(key string, data []byte) error) error {
+	s.kh.lock.RLock()
+	defer s.kh.lock.RUnlock()
+	keys, err := s.keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		info := s.datalocs[key]
+		data, err := s.kh.decode(&info)
+		if err != nil {
+			return err
+		}
+		if err = fn(key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Releases the snapshot. The blocks it kept from being reused are freed
+//once no other snapshot is open. Using the snapshot afterwards returns
+//ErrClosed, releasing it again does nothing
+func (s *Snapshot) Release() error {
+	kh := s.kh
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if s.released {
+		return nil
+	}
+	s.released = true
+	s.datalocs = nil
+	return kh.unpin()
+}
+
+func (kh *KeyHandler) unpin() error {
+	//Ends a snapshot, or a backup, freeing the held blocks once there
+	//are no others. kh.lock has to be held
+	kh.bli.snapshots--
+	if kh.bli.snapshots > 0 || kh.closed {
+		return nil
+	}
+	return kh.bli.freeHeld()
+}
+
+func (kh *KeyHandler) unreferenced() []*blockListInfo {
+	//Returns the used blocks that nothing in the file points at, in the
+	//order their entries are in the file
+	used := make(map[*blockListInfo]bool)
+	for _, ks := range kh.keySpaces() {
+		for e := ks.keyHeaders.Front(); e != nil; e = e.Next() {
+			used[e.Value.(*keyArrayHeaderInfo).Block] = true
+		}
+		mark := func(info *keyInfo) {
+			used[info.Key] = true
+			used[info.Data] = true
+		}
+		for _, info := range ks.datalocs {
+			mark(info)
+		}
+		for _, versions := range ks.history {
+			for _, info := range versions {
+				mark(info)
+			}
+		}
+	}
+	var unused []*blockListInfo
+	for _, info := range kh.bli.BlockListInfos {
+		if info.Entry.Free == 0 && info.Entry.Size > 0 && !used[info] {
+			unused = append(unused, info)
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool {
+		return unused[i].Location < unused[j].Location
+	})
+	return unused
+}
+
+func (kh *KeyHandler) reclaim() error {
+	//Frees the used blocks that nothing in the file points at. Blocks
+	//held for snapshots are only kept in memory, so they're left used if
+	//the database isn't closed, and so are the blocks of a write that was
+	//interrupted before its entry was written. They're freed in order, so
+	//they're reused the same way every time
+	bli := kh.bli
+	end, err := bli.file.Size()
+	if err != nil {
+		return err
+	}
+	for _, info := range kh.unreferenced() {
+		if info.Entry.Start+info.Entry.Size <= end {
+			if err = bli.setFree(info); err != nil {
+				return err
+			}
+			continue
+		}
+		//the write that grew the file for it was lost, so the space is
+		//handed out again at the end of the file. Only the entry is
+		//freed, and it's emptied first so a free block can't overlap
+		//what's written there
+		*info.Entry = blockListArrayEntryData{}
+		err = info.writeInfo(bli.file)
+		if err == nil {
+			err = bli.barrier()
+		}
+		if err == nil {
+			err = writeFlag(bli.file, info.Location, 1)
+		}
+		if err != nil {
+			return err
+		}
+		info.Entry.Free = 1
+		bli.Freeentries.PushBack(info)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package gokvlite
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	kh, err := OpenStorage(NewMemStorage(), &Options{Compressor: FlateCompressor{}})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	//too large to be inline even when compressed
+	large := fmt.Sprint(rand.New(rand.NewSource(1)).Perm(100))
+	before := map[string]string{"small": "1", "large": large, "deleted": "gone"}
+	for key, value := range before {
+		if err = kh.Set(key, []byte(value)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	s, err := kh.Snapshot()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	//same sized values would reuse the freed blocks without the snapshot
+	for i := 0; i < 10; i++ {
+		if err = kh.Set("large", []byte(fmt.Sprint(rand.Perm(100)))); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if err = kh.Set("small", []byte("2")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("added", []byte("new")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.Del("deleted"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	for key, value := range before {
+		data, found, err := s.Get(key)
+		if err != nil || !found || string(data) != value {
+			t.Fatalf("Incorrect data in the snapshot for %s: %v %v", key, found, err)
+		}
+	}
+	if _, found, _ := s.Get("added"); found {
+		t.Fatalf("Key added after the snapshot found in it")
+	}
+	keys, err := s.Keys()
+	if err != nil || strings.Join(keys, ",") != "deleted,large,small" {
+		t.Fatalf("Incorrect keys in the snapshot: %v %v", keys, err)
+	}
+	seen := 0
+	err = s.ForEach(func(key string, data []byte) error {
+		if string(data) != before[key] {
+			t.Fatalf("Incorrect data from ForEach for %s", key)
+		}
+		seen++
+		return nil
+	})
+	if err != nil || seen != len(before) {
+		t.Fatalf("ForEach saw %d keys: %v", seen, err)
+	}
+	if data, _, _ := kh.Get("small"); string(data) != "2" {
+		t.Fatalf("Incorrect data after the snapshot: %s", data)
+	}
+	if err = kh.Rekey(testKey); err != ErrSnapshotOpen {
+		t.Fatalf("Rekey with an open snapshot: %v", err)
+	}
+
+	held := len(kh.bli.held)
+	if held == 0 {
+		t.Fatalf("No blocks were held for the snapshot")
+	}
+	free := kh.bli.Freeblocks.Len()
+	if err = s.Release(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(kh.bli.held) != 0 || kh.bli.Freeblocks.Len() != free+held {
+		t.Fatalf("Held blocks weren't freed on release")
+	}
+	if _, _, err = s.Get("small"); err != ErrClosed {
+		t.Fatalf("Get after Release: %v", err)
+	}
+	if err = s.Release(); err != nil {
+		t.Fatalf("Second release: %v", err)
+	}
+}
+
+func TestSnapshotNotReleased(t *testing.T) {
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	large := strings.Repeat("a", 1000)
+	if err = kh.Set("large", []byte(large)); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.Snapshot(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = kh.Set("large", []byte(large)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	held := len(kh.bli.held)
+
+	//opened again without closing, as after a crash
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if free := kh.bli.Freeblocks.Len(); free < held {
+		t.Fatalf("%d of the %d held blocks were freed", free, held)
+	}
+	size, _ := ms.Size()
+	for i := 0; i < 10; i++ {
+		if err = kh.Set("large", []byte(large)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if grown, _ := ms.Size(); grown != size {
+		t.Fatalf("File grew from %d to %d", size, grown)
+	}
+	checkValues(t, kh, map[string]string{"large": large})
+}
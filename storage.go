@@ -0,0 +1,109 @@
+package gokvlite
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+//Storage is where a database keeps its data. It's usually a file, but
+//anything that can be read and written at offsets will do
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	//Returns the current size of the storage in bytes
+	Size() (int64, error)
+	//Makes sure everything written so far is durable
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+//Storage backed by an *os.File. This is what Open uses
+type FileStorage struct {
+	*os.File
+}
+
+func (fs FileStorage) Size() (int64, error) {
+	fi, err := fs.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+//Storage kept entirely in memory, for tests and temporary databases.
+//Everything is lost on Close
+type MemStorage struct {
+	lock sync.RWMutex
+	data []byte
+}
+
+//Returns an empty MemStorage
+func NewMemStorage() *MemStorage {
+	return new(MemStorage)
+}
+
+func (ms *MemStorage) ReadAt(p []byte, off int64) (int, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	if off >= int64(len(ms.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, ms.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (ms *MemStorage) WriteAt(p []byte, off int64) (int, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if end := off + int64(len(p)); end > int64(len(ms.data)) {
+		ms.grow(end)
+	}
+	return copy(ms.data[off:], p), nil
+}
+
+func (ms *MemStorage) grow(size int64) {
+	if size <= int64(cap(ms.data)) {
+		ms.data = ms.data[:size]
+		return
+	}
+	data := make([]byte, size, size*2)
+	copy(data, ms.data)
+	ms.data = data
+}
+
+func (ms *MemStorage) Size() (int64, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return int64(len(ms.data)), nil
+}
+
+func (ms *MemStorage) Sync() error {
+	return nil
+}
+
+func (ms *MemStorage) Truncate(size int64) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if size > int64(len(ms.data)) {
+		ms.grow(size)
+		return nil
+	}
+	//clear what's cut off so growing again reads back zeros
+	for i := range ms.data[size:] {
+		ms.data[size+int64(i)] = 0
+	}
+	ms.data = ms.data[:size]
+	return nil
+}
+
+func (ms *MemStorage) Close() error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.data = nil
+	return nil
+}
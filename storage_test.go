@@ -0,0 +1,121 @@
+package gokvlite
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMemStorage(t *testing.T) {
+	ms := NewMemStorage()
+	if _, err := ms.WriteAt([]byte("Testing!"), 2); err != nil {
+		t.Fatalf("Error in WriteAt: %v", err)
+	}
+	if size, _ := ms.Size(); size != 10 {
+		t.Fatalf("Incorrect size: %d", size)
+	}
+
+	b := make([]byte, 10)
+	if _, err := ms.ReadAt(b, 0); err != nil {
+		t.Fatalf("Error in ReadAt: %v", err)
+	}
+	if string(b) != "\x00\x00Testing!" {
+		t.Fatalf("Incorrect data read back: %q", b)
+	}
+
+	n, err := ms.ReadAt(b, 5)
+	if n != 5 || err != io.EOF {
+		t.Fatalf("Expected a short read at the end: %d %v", n, err)
+	}
+
+	if err = ms.Truncate(4); err != nil {
+		t.Fatalf("Error in Truncate: %v", err)
+	}
+	if err = ms.Truncate(6); err != nil {
+		t.Fatalf("Error in Truncate: %v", err)
+	}
+	b = make([]byte, 6)
+	ms.ReadAt(b, 0)
+	if string(b) != "\x00\x00Te\x00\x00" {
+		t.Fatalf("Incorrect data after truncating: %q", b)
+	}
+}
+
+func TestOpenStorage(t *testing.T) {
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer kh.Close()
+
+	for i := 0; i <= keyblocksize+20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if err = kh.Set(key, []byte(key)); err != nil {
+			t.Fatalf("Error in Set: %v", err)
+		}
+	}
+
+	//A second handle reads back what the first wrote
+	kh2, err := OpenStorage(ms, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i := 0; i <= keyblocksize+20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		data, found, err := kh2.Get(key)
+		if err != nil || !found || string(data) != key {
+			t.Fatalf("Incorrect data for %s: %s %v", key, data, err)
+		}
+	}
+
+	if _, err = OpenStorage(NewMemStorage(), &Options{ReadOnly: true}); err != ErrCorrupt {
+		t.Fatalf("Expected ErrCorrupt for empty read only storage: %v", err)
+	}
+	if _, err = OpenStorage(NewMemStorage(), &Options{Mmap: true}); err == nil {
+		t.Fatalf("Expected an error for mmap without a file")
+	}
+}
+
+//Storage that counts its syncs
+type syncCounter struct {
+	*MemStorage
+	syncs int
+}
+
+func (sc *syncCounter) Sync() error {
+	sc.syncs++
+	return sc.MemStorage.Sync()
+}
+
+func TestNoSync(t *testing.T) {
+	for _, noSync := range []bool{false, true} {
+		sc := &syncCounter{MemStorage: NewMemStorage()}
+		kh, err := OpenStorage(sc, &Options{NoSync: noSync})
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		value := []byte(strings.Repeat("a", 100))
+		for i := 0; i < 3; i++ {
+			if err = kh.Set("key", value); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+		}
+		//the overwrites from now on reuse the freed blocks, so they
+		//don't grow the file, which syncs either way
+		sc.syncs = 0
+		for i := 0; i < 10; i++ {
+			if err = kh.Set("key", value); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			if _, err = kh.Del("other"); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+		}
+		if noSync && sc.syncs != 0 || !noSync && sc.syncs == 0 {
+			t.Fatalf("%d syncs with NoSync %v", sc.syncs, noSync)
+		}
+		checkValues(t, kh, map[string]string{"key": string(value)})
+	}
+}
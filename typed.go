@@ -0,0 +1,195 @@
+package gokvlite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"unsafe"
+)
+
+//Store has the methods KeyHandler and Bucket have in common, so that
+//Typed can use either
+type Store interface {
+	Get(key string) (data []byte, found bool, err error)
+	Set(key string, data []byte) error
+	Del(key string) (existed bool, err error)
+	Keys() ([]string, error)
+	ForEach(fn func(key string, data []byte) error) error
+}
+
+//A Codec converts values of type T to bytes and back
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+//Stores strings as they are
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
+
+//Stores byte slices as they are
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(v []byte) ([]byte, error) {
+	return v, nil
+}
+
+func (BytesCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+//Stores values as JSON with encoding/json
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+//Stores values with encoding/gob. Each value carries its own type
+//information, so it's larger than with a shared gob stream
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+//The types IntCodec works with
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+//Stores integers as big endian numbers the size of T. The sign bit of
+//signed types is flipped, so that as keys they're in numeric order
+type IntCodec[T Integer] struct{}
+
+func (IntCodec[T]) signBit() uint64 {
+	var zero T
+	if zero-1 > 0 {
+		return 0
+	}
+	return 1 << (unsafe.Sizeof(zero)*8 - 1)
+}
+
+func (c IntCodec[T]) Encode(v T) ([]byte, error) {
+	size := int(unsafe.Sizeof(v))
+	u := uint64(v) ^ c.signBit()
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, u)
+	return buf[8-size:], nil
+}
+
+func (c IntCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	size := int(unsafe.Sizeof(v))
+	if len(data) != size {
+		return v, fmt.Errorf("gokvlite: IntCodec: expected %d bytes, got %d", size, len(data))
+	}
+	buf := make([]byte, 8)
+	copy(buf[8-size:], data)
+	return T(binary.BigEndian.Uint64(buf) ^ c.signBit()), nil
+}
+
+//Typed wraps a Store so that keys and values have Go types, converting
+//them with codecs
+type Typed[K comparable, V any] struct {
+	store  Store
+	keys   Codec[K]
+	values Codec[V]
+}
+
+//Returns a Typed over store, which is usually a *KeyHandler or a
+//*Bucket. Keys are ordered by their encoded bytes
+func NewTyped[K comparable, V any](store Store, keys Codec[K], values Codec[V]) *Typed[K, V] {
+	return &Typed[K, V]{store, keys, values}
+}
+
+//Gets the value of key. found is false if the key doesn't exist
+func (t *Typed[K, V]) Get(key K) (value V, found bool, err error) {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return value, false, err
+	}
+	data, found, err := t.store.Get(string(k))
+	if err != nil || !found {
+		return value, found, err
+	}
+	value, err = t.values.Decode(data)
+	return value, err == nil, err
+}
+
+//Sets key to value
+func (t *Typed[K, V]) Set(key K, value V) error {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return err
+	}
+	data, err := t.values.Encode(value)
+	if err != nil {
+		return err
+	}
+	return t.store.Set(string(k), data)
+}
+
+//Deletes key if it exists. existed is false if it didn't
+func (t *Typed[K, V]) Del(key K) (existed bool, err error) {
+	k, err := t.keys.Encode(key)
+	if err != nil {
+		return false, err
+	}
+	return t.store.Del(string(k))
+}
+
+//Returns all the keys in order
+func (t *Typed[K, V]) Keys() ([]K, error) {
+	raw, err := t.store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]K, len(raw))
+	for i, k := range raw {
+		if keys[i], err = t.keys.Decode([]byte(k)); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+//Calls fn with each key and value in key order, stopping at the first
+//error fn returns. fn must not write to the store
+func (t *Typed[K, V]) ForEach(fn func(key K, value V) error) error {
+	return t.store.ForEach(func(k string, data []byte) error {
+		key, err := t.keys.Decode([]byte(k))
+		if err != nil {
+			return err
+		}
+		value, err := t.values.Decode(data)
+		if err != nil {
+			return err
+		}
+		return fn(key, value)
+	})
+}
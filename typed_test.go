@@ -0,0 +1,89 @@
+package gokvlite
+
+import (
+	"bytes"
+	"testing"
+)
+
+type testUser struct {
+	Name string
+	Age  int
+}
+
+func TestTyped(t *testing.T) {
+	kh, err := OpenStorage(NewMemStorage(), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	users := NewTyped[string, testUser](kh, StringCodec{}, JSONCodec[testUser]{})
+	if err = users.Set("bob", testUser{"Bob", 40}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	users.Set("alice", testUser{"Alice", 30})
+	user, found, err := users.Get("bob")
+	if err != nil || !found || user != (testUser{"Bob", 40}) {
+		t.Fatalf("Incorrect value: %+v %v %v", user, found, err)
+	}
+	if _, found, _ = users.Get("carol"); found {
+		t.Fatalf("Found a missing key")
+	}
+	var names []string
+	users.ForEach(func(key string, user testUser) error {
+		names = append(names, user.Name)
+		return nil
+	})
+	if len(names) != 2 || names[0] != "Alice" {
+		t.Fatalf("Incorrect iteration: %v", names)
+	}
+	if existed, _ := users.Del("bob"); !existed {
+		t.Fatalf("Del didn't find the key")
+	}
+
+	//the keys sort in numeric order, negative ones included
+	b, err := kh.CreateBucket("counts")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	counts := NewTyped[int32, []string](b, IntCodec[int32]{}, GobCodec[[]string]{})
+	for _, n := range []int32{300, -5, 2, -1000, 0} {
+		if err = counts.Set(n, []string{"x"}); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	keys, err := counts.Keys()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i, n := range []int32{-1000, -5, 0, 2, 300} {
+		if keys[i] != n {
+			t.Fatalf("Incorrect key order: %v", keys)
+		}
+	}
+	if v, _, err := counts.Get(-5); err != nil || len(v) != 1 || v[0] != "x" {
+		t.Fatalf("Incorrect value: %v %v", v, err)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	for _, v := range []uint16{0, 1, 65535} {
+		data, _ := IntCodec[uint16]{}.Encode(v)
+		if len(data) != 2 {
+			t.Fatalf("Incorrect size: %d", len(data))
+		}
+		if back, err := (IntCodec[uint16]{}).Decode(data); err != nil || back != v {
+			t.Fatalf("Incorrect value: %d %v", back, err)
+		}
+	}
+	a, _ := IntCodec[int64]{}.Encode(-1)
+	b, _ := IntCodec[int64]{}.Encode(1)
+	if bytes.Compare(a, b) >= 0 {
+		t.Fatalf("-1 doesn't sort before 1")
+	}
+	if _, err := (IntCodec[int64]{}).Decode([]byte{1}); err == nil {
+		t.Fatalf("Expected an error for the wrong size")
+	}
+	data, _ := BytesCodec{}.Encode([]byte("raw"))
+	if s, _ := (StringCodec{}).Decode(data); s != "raw" {
+		t.Fatalf("Incorrect value: %s", s)
+	}
+}
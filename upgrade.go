@@ -0,0 +1,141 @@
+package gokvlite
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+//The header of the first layout, which didn't have a version. The first
+//block list always came right after it, so an old file starts with its
+//size, which no formatVersion is
+type legacyHeader struct {
+	Freeblock_start int64
+	Data_start      int64
+}
+
+const legacyHeaderSize = 16
+
+//A key entry of the first layout. The block lists were the same
+type legacyKeyEntry struct {
+	Free    uint8
+	Keyloc  int64
+	Dataloc int64
+}
+
+//Rewrites a database in the first file layout, which Open returns
+//ErrOldFormat for, in the current one. The keys are written to a new
+//file next to path, opened with opts, which is renamed over path once
+//it's complete and synced, so path is never left half upgraded. Does
+//nothing if path is already in the current layout
+func Upgrade(path string, opts *Options) error {
+	old, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	var header legacyHeader
+	if err = readFrom(old, 0, &header); err != nil {
+		return err
+	}
+	switch header.Freeblock_start {
+	case formatVersion:
+		return nil
+	case legacyHeaderSize:
+	default:
+		return fmt.Errorf("upgrade: unknown format version %d: %w", header.Freeblock_start, ErrCorrupt)
+	}
+	fi, err := old.Stat()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	newOpts := Options{}
+	if opts != nil {
+		newOpts = *opts
+	}
+	newOpts.ReadOnly = false
+	newOpts.Follower = false
+	kh, err := OpenStorage(FileStorage{file}, &newOpts)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	err = copyLegacy(old, fi.Size(), header.Data_start, kh)
+	if err == nil {
+		err = kh.bli.file.Sync()
+	}
+	if closeErr := kh.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func copyLegacy(r io.ReaderAt, size int64, start int64, kh *KeyHandler) error {
+	//Sets every key in the key arrays of a file in the first layout,
+	//starting with the one at start
+	entrySize := int64(binary.Size(legacyKeyEntry{}))
+	visited := make(map[int64]bool)
+	for start != 0 {
+		var header keyArrayHeader
+		if visited[start] || readFrom(r, start, &header) != nil || header.Size*entrySize > size {
+			return fmt.Errorf("upgrade: Invalid key array at %d: %w", start, ErrCorrupt)
+		}
+		visited[start] = true
+
+		offset := start + int64(binary.Size(header))
+		for i := int64(0); i < header.Size; i++ {
+			var entry legacyKeyEntry
+			if err := readFrom(r, offset, &entry); err != nil {
+				return err
+			}
+			offset += entrySize
+			if entry.Free > 0 {
+				continue
+			}
+			key, err := readLegacyBlock(r, size, entry.Keyloc)
+			if err != nil {
+				return err
+			}
+			data, err := readLegacyBlock(r, size, entry.Dataloc)
+			if err != nil {
+				return err
+			}
+			if err = kh.Set(string(key), data); err != nil {
+				return err
+			}
+		}
+		start = header.Next
+	}
+	return nil
+}
+
+func readLegacyBlock(r io.ReaderAt, size int64, location int64) ([]byte, error) {
+	//Reads the block whose block list entry is at location
+	var entry blockListArrayEntryData
+	if err := readFrom(r, location, &entry); err != nil {
+		return nil, err
+	}
+	if entry.Start < 0 || entry.Size < 0 || entry.Start+entry.Size > size {
+		return nil, fmt.Errorf("upgrade: Invalid block at %d: %w", location, ErrCorrupt)
+	}
+	info := blockListInfo{&entry, location}
+	data, err := info.ReadData(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return *data, nil
+}
@@ -0,0 +1,109 @@
+package gokvlite
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeLegacyFile(path string, values map[string]string) error {
+	//Writes values to path in the first layout: the header, one block
+	//list, one key array, then the keys and values
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	blockList := int64(legacyHeaderSize)
+	entrySize := int64(binary.Size(blockListArrayEntryData{}))
+	keyArray := blockList + 16 + freeBlockSize*entrySize
+	keyEntrySize := int64(binary.Size(legacyKeyEntry{}))
+	end := keyArray + 16 + keyblocksize*keyEntrySize
+
+	if err = writeTo(file, 0, legacyHeader{blockList, keyArray}); err != nil {
+		return err
+	}
+	if err = writeTo(file, blockList, blockListHeaderData{0, freeBlockSize}); err != nil {
+		return err
+	}
+	if err = writeTo(file, keyArray, keyArrayHeader{0, keyblocksize}); err != nil {
+		return err
+	}
+	blocks := []blockListArrayEntryData{{0, keyArray, end - keyArray}}
+	block := func(data string) (int64, error) {
+		//writes data at the end and returns where its block entry is
+		blocks = append(blocks, blockListArrayEntryData{0, end, int64(len(data))})
+		_, err := file.WriteAt([]byte(data), end)
+		end += int64(len(data))
+		return blockList + 16 + int64(len(blocks)-1)*entrySize, err
+	}
+	i := int64(0)
+	for key, value := range values {
+		keyloc, err := block(key)
+		if err != nil {
+			return err
+		}
+		dataloc, err := block(value)
+		if err != nil {
+			return err
+		}
+		if err = writeTo(file, keyArray+16+i*keyEntrySize, legacyKeyEntry{0, keyloc, dataloc}); err != nil {
+			return err
+		}
+		i++
+	}
+	for ; i < keyblocksize; i++ {
+		if err = writeTo(file, keyArray+16+i*keyEntrySize, legacyKeyEntry{Free: 1}); err != nil {
+			return err
+		}
+	}
+	for len(blocks) < freeBlockSize {
+		blocks = append(blocks, blockListArrayEntryData{Free: 1})
+	}
+	return writeTo(file, blockList+16, blocks)
+}
+
+func TestUpgrade(t *testing.T) {
+	dir, err := os.MkdirTemp("", "gotest_upgrade")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db")
+	values := map[string]string{"a": "1", "empty": "", "long": string(make([]byte, 5000))}
+	if err = writeLegacyFile(path, values); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if _, err = Open(path); !errors.Is(err, ErrOldFormat) {
+		t.Fatalf("Opened a file in the first layout: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		//the second time the file is already upgraded
+		if err = Upgrade(path, nil); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		kh, err := Open(path)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		m, err := ExportMap(kh)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if len(m) != len(values) {
+			t.Fatalf("Upgraded %d keys, expected %d", len(m), len(values))
+		}
+		for key, value := range values {
+			if string(m[key]) != value {
+				t.Fatalf("Incorrect value for %q: %q", key, m[key])
+			}
+		}
+		kh.Close()
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("Upgrade left %d files", len(files))
+	}
+}
@@ -11,6 +11,7 @@ type sectionWriter struct {
 
 func (sw *sectionWriter) Write(data []byte) (n int, err error) {
 	n, err = sw.file.WriteAt(data, sw.offset)
+	sw.offset += int64(n)
 	return
 }
 
@@ -20,3 +21,14 @@ func newSectionWriter(w io.WriterAt, off int64) *sectionWriter {
 	sw.offset = off
 	return sw
 }
+
+func grow(b []byte, n int) []byte {
+	//Makes sure b has room for n more bytes past its length.
+	//Never returns nil, so an empty value can be told apart from a missing one
+	if b != nil && cap(b)-len(b) >= n {
+		return b
+	}
+	nb := make([]byte, len(b), len(b)+n)
+	copy(nb, b)
+	return nb
+}
@@ -0,0 +1,230 @@
+package gokvlite
+
+import (
+	"sort"
+)
+
+//Every write gets the next sequence number, which is kept in its entry.
+//With Options.KeepVersions the entries a key had before are kept too,
+//along with an entry for each Del, so the value a key had after any
+//write can be read back with GetAt
+
+//A Version is one of the values a key had, see History
+type Version struct {
+	//the write that set the value
+	Seq int64
+	//the write was a Del
+	Deleted bool
+}
+
+func (kh *KeyHandler) nextSeq() int64 {
+	kh.seq++
+	return kh.seq
+}
+
+func (kh *KeyHandler) saveSeq() error {
+	//Writes the last seq to the header when there may be no entry left
+	//with it, so it's never handed out again
+	header := kh.bli.fileheader
+	if header.Seq >= kh.seq {
+		return nil
+	}
+	header.Seq = kh.seq
+	return kh.bli.writeHeader()
+}
+
+func (kh *KeyHandler) deletedFlags(key string, flags uint8) uint8 {
+	//Returns the flags of the entry for deleting key
+	if kh.inline(key, 0) {
+		return flagDeleted | flagInline
+	}
+	return flagDeleted | flags&flagKeyEncrypted
+}
+
+func (kh *KeyHandler) readHistory() error {
+	//Moves the deletes that were read into datalocs as the newest entry
+	//of their key to the history, then puts the history in order and
+	//drops what's past Options.KeepVersions. The versions are read even
+	//without it, so they're only ever dropped by trim or prune
+	ks := &kh.keySpace
+	for key, info := range ks.datalocs {
+		if info.Flags&flagDeleted == 0 {
+			continue
+		}
+		delete(ks.datalocs, key)
+		ks.history[key] = append(ks.history[key], info)
+	}
+	for key, versions := range ks.history {
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].Seq < versions[j].Seq
+		})
+		if kh.readOnly {
+			continue
+		}
+		if err := ks.trim(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ks *keySpace) versioned(key string) bool {
+	//Returns if the writes to key are kept as versions. Without
+	//Options.KeepVersions they still are for keys that have versions, as
+	//GetAt would otherwise skip the ones freed between them
+	return ks.history != nil && (ks.kh.keepVersions != 0 || len(ks.history[key]) > 0)
+}
+
+func (ks *keySpace) retire(key string, old *keyInfo, newer *keyInfo) error {
+	//Keeps old as an earlier version of key, or frees what it doesn't
+	//share with newer if it isn't versioned
+	if !ks.versioned(key) {
+		return ks.release(old, newer)
+	}
+	ks.history[key] = append(ks.history[key], old)
+	return ks.trim(key)
+}
+
+func (ks *keySpace) retireDeleted(key string, old *keyInfo, seq int64) error {
+	//Keeps old as an earlier version of the deleted key, followed by an
+	//entry for the delete numbered seq
+	kh := ks.kh
+	flags := kh.deletedFlags(key, ks.encryptFlags()) | flagVersioned
+	info, err := ks.writeVersion(key, nil, seq, 0, flags, true, nil)
+	if err != nil {
+		//old is still the newest entry in the file
+		ks.datalocs[key] = old
+		return err
+	}
+	ks.history[key] = append(ks.history[key], old, info)
+	return ks.trim(key)
+}
+
+func (ks *keySpace) trim(key string) error {
+	//Frees the oldest versions of key past Options.KeepVersions
+	keep := ks.kh.keepVersions
+	versions := ks.history[key]
+	for keep > 0 && len(versions) > keep {
+		err := ks.release(versions[0], nil)
+		versions = versions[1:]
+		if err != nil {
+			ks.history[key] = versions
+			return err
+		}
+	}
+	ks.history[key] = versions
+	return nil
+}
+
+func (ks *keySpace) prune(key string, before int64) error {
+	//Frees the versions of key that were replaced by a write before
+	//before. A delete with nothing after it goes too, since reading any
+	//seq from then on finds nothing either way
+	versions := ks.history[key]
+	for len(versions) > 0 {
+		replaced := versions[0].Seq
+		switch {
+		case len(versions) > 1:
+			replaced = versions[1].Seq
+		case ks.datalocs[key] != nil:
+			replaced = ks.datalocs[key].Seq
+		case versions[0].Flags&flagDeleted == 0:
+			//never replaced, so it's kept
+			replaced = before
+		}
+		if replaced >= before {
+			break
+		}
+		err := ks.release(versions[0], nil)
+		versions = versions[1:]
+		if err != nil {
+			ks.history[key] = versions
+			return err
+		}
+	}
+	if len(versions) == 0 {
+		delete(ks.history, key)
+		return nil
+	}
+	ks.history[key] = versions
+	return nil
+}
+
+func (ks *keySpace) versionAt(key string, seq int64) *keyInfo {
+	//Returns the version key had after the write seq, or nil if it
+	//didn't exist then
+	if info, ok := ks.datalocs[key]; ok && info.Seq <= seq {
+		return info
+	}
+	versions := ks.history[key]
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].Seq > seq
+	})
+	if i == 0 || versions[i-1].Flags&flagDeleted != 0 {
+		return nil
+	}
+	return versions[i-1]
+}
+
+//Returns the sequence number of the last write. Every Set and Del,
+//including the ones to buckets, gets a higher one than the write before
+//it, also across opens
+func (kh *KeyHandler) Seq() int64 {
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	return kh.seq
+}
+
+//Returns the data key had after the write numbered seq, and if it
+//existed then. Only the versions kept with Options.KeepVersions can be
+//read, so a key is not found at a seq older than its oldest version
+func (kh *KeyHandler) GetAt(key string, seq int64) (data []byte, found bool, err error) {
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	if kh.closed {
+		return nil, false, ErrClosed
+	}
+	info := kh.versionAt(key, seq)
+	if info == nil {
+		return nil, false, nil
+	}
+	data, err = kh.decodeCopy(info)
+	return data, err == nil, err
+}
+
+//Returns the versions of key that are kept, oldest first and ending with
+//the current value if the key exists. Without Options.KeepVersions
+//that's the only one, unless the key has versions from when the file
+//was opened with it
+func (kh *KeyHandler) History(key string) ([]Version, error) {
+	kh.lock.RLock()
+	defer kh.lock.RUnlock()
+	if kh.closed {
+		return nil, ErrClosed
+	}
+	versions := make([]Version, 0, len(kh.history[key])+1)
+	for _, info := range kh.history[key] {
+		versions = append(versions, Version{info.Seq, info.Flags&flagDeleted != 0})
+	}
+	if info, ok := kh.datalocs[key]; ok {
+		versions = append(versions, Version{info.Seq, false})
+	}
+	return versions, nil
+}
+
+//Frees the earlier versions of every key that were replaced by a write
+//numbered below before, so GetAt still reads the same for any seq from
+//before on. It's for keeping versions for a time rather than by count
+func (kh *KeyHandler) PruneVersions(before int64) error {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if err := kh.checkWrite(""); err != nil {
+		return err
+	}
+	for key := range kh.history {
+		if err := kh.prune(key, before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package gokvlite
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func checkHistory(t *testing.T, kh *KeyHandler, key string, want []Version) {
+	history, err := kh.History(key)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if fmt.Sprint(history) != fmt.Sprint(want) {
+		t.Fatalf("Incorrect history for %s: %v, expected %v", key, history, want)
+	}
+}
+
+func checkAt(t *testing.T, kh *KeyHandler, key string, seq int64, want *string) {
+	data, found, err := kh.GetAt(key, seq)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if want == nil && found || want != nil && (!found || string(data) != *want) {
+		t.Fatalf("Incorrect data for %s at %d: %q %v", key, seq, data, found)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	ms := NewMemStorage()
+	opts := &Options{KeepVersions: -1}
+	kh, err := OpenStorage(ms, opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	large := strings.Repeat("version-2", 10)
+	values := []string{"version-1", large, "version-3"}
+	var seqs []int64
+	for i, value := range values {
+		if i == 2 {
+			if _, err = kh.Del("key"); err != nil {
+				t.Fatalf("Error: %v", err)
+			}
+			seqs = append(seqs, kh.Seq())
+		}
+		if err = kh.Set("key", []byte(value)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		seqs = append(seqs, kh.Seq())
+	}
+	want := []Version{{seqs[0], false}, {seqs[1], false}, {seqs[2], true}, {seqs[3], false}}
+
+	for i := 0; i < 2; i++ {
+		checkHistory(t, kh, "key", want)
+		checkAt(t, kh, "key", seqs[0]-1, nil)
+		checkAt(t, kh, "key", seqs[0], &values[0])
+		checkAt(t, kh, "key", seqs[1], &values[1])
+		checkAt(t, kh, "key", seqs[2], nil)
+		checkAt(t, kh, "key", seqs[3], &values[2])
+		if data, _, _ := kh.Get("key"); string(data) != values[2] {
+			t.Fatalf("Incorrect current data: %s", data)
+		}
+		kh, err = OpenStorage(ms, opts)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+
+	//seqs keep going up across opens, also when the last write was a
+	//delete that left nothing behind
+	if err = kh.Set("other", []byte("1")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.Del("other"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	last := kh.Seq()
+	if last <= seqs[3] {
+		t.Fatalf("Seq went from %d to %d", seqs[3], last)
+	}
+	kh, err = OpenStorage(ms, opts)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if kh.Seq() != last {
+		t.Fatalf("Seq is %d after reopening, expected %d", kh.Seq(), last)
+	}
+
+	//opening without KeepVersions kept the earlier versions, and writes
+	//to the key still add to them
+	checkHistory(t, kh, "key", want)
+	kh, err = OpenStorage(ms, nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("key", []byte("version-4")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	want = append(want, Version{kh.Seq(), false})
+	checkHistory(t, kh, "key", want)
+	checkAt(t, kh, "key", seqs[3], &values[2])
+	if err = kh.PruneVersions(kh.Seq() + 1); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkHistory(t, kh, "key", want[4:])
+	if bytes.Contains(ms.data, []byte("version-1")) {
+		t.Fatalf("Pruned version left in the file")
+	}
+	if err = kh.Set("key", []byte("version-5")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkHistory(t, kh, "key", []Version{{kh.Seq(), false}})
+}
+
+func TestKeepVersions(t *testing.T) {
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, &Options{KeepVersions: 2})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	var seqs []int64
+	for i := 0; i < 5; i++ {
+		if err = kh.Set("key", []byte(strings.Repeat(fmt.Sprint(i), 100))); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		seqs = append(seqs, kh.Seq())
+	}
+	checkHistory(t, kh, "key", []Version{{seqs[2], false}, {seqs[3], false}, {seqs[4], false}})
+	checkAt(t, kh, "key", seqs[1], nil)
+	//the key array, and a key and a data block for each version
+	if used := len(kh.bli.usedStarts()); used != 7 {
+		t.Fatalf("Versions past KeepVersions weren't freed, %d blocks used", used)
+	}
+
+	kh, err = OpenStorage(ms, &Options{KeepVersions: -1})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.Del("key"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	deleted := kh.Seq()
+	if err = kh.PruneVersions(seqs[4]); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkHistory(t, kh, "key", []Version{{seqs[3], false}, {seqs[4], false}, {deleted, true}})
+	if err = kh.PruneVersions(deleted + 1); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkHistory(t, kh, "key", []Version{})
+}
+
+func TestRekeyVersions(t *testing.T) {
+	ms := NewMemStorage()
+	kh, err := OpenStorage(ms, &Options{KeepVersions: -1})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	values := []string{"version-1", strings.Repeat("version-2", 10)}
+	for _, value := range values {
+		if err = kh.Set("key", []byte(value)); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+	if _, err = kh.Del("key"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	history, _ := kh.History("key")
+	if err = kh.Rekey(testKey); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if bytes.Contains(ms.data, []byte("version-")) {
+		t.Fatalf("Plain text version left in the file")
+	}
+
+	kh, err = OpenStorage(ms, &Options{KeepVersions: -1, EncryptionKey: testKey})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	checkHistory(t, kh, "key", history)
+	for i, value := range values {
+		checkAt(t, kh, "key", history[i].Seq, &value)
+	}
+	checkAt(t, kh, "key", history[2].Seq, nil)
+}
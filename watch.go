@@ -0,0 +1,135 @@
+package gokvlite
+
+import (
+	"strings"
+)
+
+//Events a Watcher hasn't received yet are kept up to this many at a
+//time by default, see Options.WatchBuffer
+const defaultWatchBuffer = 1024
+
+//An Op is the kind of write an Event is for
+type Op uint8
+
+const (
+	OpSet Op = iota + 1
+	OpDel
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpSet:
+		return "set"
+	case OpDel:
+		return "del"
+	}
+	return "unknown"
+}
+
+//An Event is a write to a key, sent to the watchers of the key once the
+//write is done
+type Event struct {
+	Key string
+	Op  Op
+	//the Seq of the write
+	Seq int64
+}
+
+//A Watcher receives an Event for each write to the keys of a KeyHandler
+//that start with its prefix, in the order of the writes. Keys in buckets
+//aren't included. Writes never wait for a watcher: one that falls behind
+//by more than Options.WatchBuffer events is closed, and Err returns
+//ErrWatchOverflow
+type Watcher struct {
+	kh     *KeyHandler
+	prefix string
+	events chan Event
+	err    error
+	closed bool
+}
+
+//Returns a Watcher for the writes to the keys that start with prefix,
+//from the next write on. An empty prefix watches every key
+func (kh *KeyHandler) Watch(prefix string) (*Watcher, error) {
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if kh.closed {
+		return nil, ErrClosed
+	}
+	w := &Watcher{kh: kh, prefix: prefix, events: make(chan Event, kh.watchBuffer)}
+	kh.watchers = append(kh.watchers, w)
+	return w, nil
+}
+
+func (kh *KeyHandler) notify(ks *keySpace, key string, op Op) {
+	//Sends the write just made to key to its watchers, closing the ones
+	//that are full
+	if ks != &kh.keySpace || len(kh.watchers) == 0 {
+		return
+	}
+	event := Event{key, op, kh.seq}
+	watchers := kh.watchers[:0]
+	for _, w := range kh.watchers {
+		if !strings.HasPrefix(key, w.prefix) {
+			watchers = append(watchers, w)
+			continue
+		}
+		select {
+		case w.events <- event:
+			watchers = append(watchers, w)
+		default:
+			w.stop(ErrWatchOverflow)
+		}
+	}
+	kh.watchers = watchers
+}
+
+func (kh *KeyHandler) stopWatchers(err error) {
+	for _, w := range kh.watchers {
+		w.stop(err)
+	}
+	kh.watchers = nil
+}
+
+func (w *Watcher) stop(err error) {
+	//Closes the channel once, keeping the first reason
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.err = err
+	close(w.events)
+}
+
+//Returns the channel the events are sent on. It's closed when the
+//Watcher is closed, after the events that were already sent
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+//Returns why the Watcher was closed: ErrWatchOverflow if it fell
+//behind, ErrClosed if the KeyHandler was closed, or nil if it's still
+//open or was closed with Close
+func (w *Watcher) Err() error {
+	w.kh.lock.RLock()
+	defer w.kh.lock.RUnlock()
+	return w.err
+}
+
+//Stops sending events to the Watcher and closes its channel
+func (w *Watcher) Close() error {
+	kh := w.kh
+	kh.lock.Lock()
+	defer kh.lock.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.stop(nil)
+	for i, other := range kh.watchers {
+		if other == w {
+			kh.watchers = append(kh.watchers[:i], kh.watchers[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
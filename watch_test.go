@@ -0,0 +1,101 @@
+package gokvlite
+
+import (
+	"testing"
+)
+
+func TestWatch(t *testing.T) {
+	kh, err := OpenStorage(NewMemStorage(), &Options{WatchBuffer: 2})
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	w, err := kh.Watch("user/")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	all, err := kh.Watch("")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	if err = kh.Set("user/1", []byte("a")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	set := kh.Seq()
+	if err = kh.Set("other", []byte("b")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.Del("user/2"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err = kh.Del("user/1"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	del := kh.Seq()
+	b, err := kh.CreateBucket("user/")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = b.Set("user/3", []byte("c")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+
+	want := []Event{{"user/1", OpSet, set}, {"user/1", OpDel, del}}
+	for _, event := range want {
+		if got := <-w.Events(); got != event {
+			t.Fatalf("Incorrect event: %v, expected %v", got, event)
+		}
+	}
+	select {
+	case event := <-w.Events():
+		t.Fatalf("Unexpected event: %v", event)
+	default:
+	}
+
+	//deleting user/1 overflowed the watcher of every key, which keeps
+	//the events from before
+	if err = all.Err(); err != ErrWatchOverflow {
+		t.Fatalf("Incorrect error for a full watcher: %v", err)
+	}
+	var keys []string
+	for event := range all.Events() {
+		keys = append(keys, event.Key)
+	}
+	if len(keys) != 2 || keys[0] != "user/1" || keys[1] != "other" {
+		t.Fatalf("Incorrect events before the overflow: %v", keys)
+	}
+
+	if err = kh.Close(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, ok := <-w.Events(); ok || w.Err() != ErrClosed {
+		t.Fatalf("Watcher wasn't closed with the KeyHandler: %v", w.Err())
+	}
+	if _, err = kh.Watch(""); err != ErrClosed {
+		t.Fatalf("Incorrect error watching a closed KeyHandler: %v", err)
+	}
+}
+
+func TestWatchClose(t *testing.T) {
+	kh, err := OpenStorage(NewMemStorage(), nil)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer kh.Close()
+	w, err := kh.Watch("")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if err = kh.Set("key", []byte("value")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, ok := <-w.Events(); ok || w.Err() != nil {
+		t.Fatalf("Closed watcher got an event: %v", w.Err())
+	}
+	if len(kh.watchers) != 0 {
+		t.Fatalf("Closed watcher is still registered")
+	}
+}